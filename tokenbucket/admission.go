@@ -0,0 +1,44 @@
+package tokenbucket
+
+import "errors"
+
+// ErrVetoed is returned by WaitContext and WaitOp when the limiter's
+// admission filter rejects a take.
+var ErrVetoed = errors.New("tokenbucket: take vetoed by admission filter")
+
+// vetoed reports whether the admission filter given by
+// WithAdmissionFilter rejects a take of count tokens with the given
+// tag. It must be called without l.mtx held. Such rejections are
+// counted in the limiter's stats and reported to the OnReject
+// callback.
+func (l *Limiter) vetoed(count int64, tag string) bool {
+	if l.admit == nil || l.admit(count) {
+		return false
+	}
+	l.mtx.Lock()
+	l.stats.Rejected++
+	l.mtx.Unlock()
+	if l.onReject != nil {
+		l.onReject(count, tag)
+	}
+	return true
+}
+
+// refusal reports whether a take of count tokens with the given tag
+// is rejected outright, without consulting the bucket, returning
+// ErrVetoed if the admission filter vetoes it, ErrPenalized if it is
+// rejected because of a penalty, and nil otherwise. floored is as
+// for penalized. It must be called without l.mtx held.
+func (l *Limiter) refusal(count int64, tag string) (floored bool, err error) {
+	if l.vetoed(count, tag) {
+		return false, ErrVetoed
+	}
+	rejected, floored := l.penalized(count)
+	if !rejected {
+		return floored, nil
+	}
+	if l.onReject != nil {
+		l.onReject(count, tag)
+	}
+	return false, ErrPenalized
+}
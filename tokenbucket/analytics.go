@@ -0,0 +1,184 @@
+package tokenbucket
+
+import (
+	"context"
+	"math"
+	"time"
+)
+
+// expectedWaitHorizon holds the period of sustained load over which
+// ExpectedWait averages the wait.
+const expectedWaitHorizon = time.Minute
+
+// ExpectedWait estimates the average time a request waits for
+// its token when requests for single tokens arrive at random
+// (as a Poisson process) at offeredPerSec requests per second,
+// over the first minute of such load.
+//
+// The estimate models the limiter as an M/D/1 queue served at
+// the limiter's rate μ, whose steady state wait is ρ/(2μ(1-ρ)) for
+// utilisation ρ = offeredPerSec/μ. Within a minute the queue cannot
+// grow much beyond the spread of the number of arrivals, √(λT) for
+// λ = offeredPerSec and T a minute, which takes √(λT)/(2μ) to serve
+// on average, so the estimate combines the two as a harmonic sum.
+// Once the offered load exceeds the rate, the backlog also grows by
+// λ-μ requests a second, adding (λ-μ)T/(2μ) on average over the
+// minute. The estimate thus stays finite, and keeps growing with
+// the load. The queue ignores the burst capacity of the bucket, so
+// the estimate is an upper bound that is closest for small buckets.
+func (l *Limiter) ExpectedWait(offeredPerSec float64) time.Duration {
+	if offeredPerSec <= 0 {
+		return 0
+	}
+	rate := l.Rate()
+	horizon := expectedWaitHorizon.Seconds()
+	spread := math.Sqrt(offeredPerSec*horizon) / (2 * rate)
+	wait := spread
+	if rho := offeredPerSec / rate; rho < 1 {
+		steady := rho / (2 * rate * (1 - rho))
+		wait = steady * spread / (steady + spread)
+	}
+	if excess := offeredPerSec - rate; excess > 0 {
+		wait += excess * horizon / (2 * rate)
+	}
+	if wait >= infinityDuration.Seconds() {
+		return infinityDuration
+	}
+	return time.Duration(wait * 1e9)
+}
+
+// WorstCaseWait returns how long a new caller taking count tokens
+// now would have to wait, given that every caller already waiting
+// for reserved tokens is served first. Because reserved tokens are
+// deducted from the bucket as soon as they are reserved, this is
+// exactly the wait Take would return, including any pacing under
+// WithMaxBurstRate, but no tokens are taken.
+func (l *Limiter) WorstCaseWait(count int64) time.Duration {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if count <= 0 {
+		return 0
+	}
+	now := l.now()
+	at := now.Add(l.accrualTime(now, count))
+	return l.pacedAt(now, at, count).Sub(now)
+}
+
+// MinCapacityFor returns the smallest capacity with which a full
+// bucket, filling at the limiter's rate, serves a burst of requests
+// for single tokens arriving at demandPerSec requests per second for
+// maxBurstWindow without any of them waiting. Only tokens added at
+// whole fill intervals within the window are counted on, so the
+// result is conservative by up to a quantum. The result is at least
+// one.
+func (l *Limiter) MinCapacityFor(demandPerSec float64, maxBurstWindow time.Duration) int64 {
+	l.mtx.Lock()
+	fillInterval, quantum := l.fillInterval, l.quantum
+	l.mtx.Unlock()
+
+	demand := int64(math.Ceil(demandPerSec * maxBurstWindow.Seconds()))
+	refill := int64(maxBurstWindow/fillInterval) * quantum
+	if need := demand - refill; need > 1 {
+		return need
+	}
+	return 1
+}
+
+// SustainableClients returns how many clients, each demanding
+// perClientDemand tokens per second on average, the limiter's rate
+// can serve without throttling them: the rate divided by the demand,
+// rounded down. It is zero if a single client demands more than the
+// rate. It panics if perClientDemand is not positive.
+func (l *Limiter) SustainableClients(perClientDemand float64) int64 {
+	if perClientDemand <= 0 {
+		panic("token bucket client demand is not > 0")
+	}
+	n := math.Floor(l.Rate() / perClientDemand)
+	if n >= math.MaxInt64 {
+		return math.MaxInt64
+	}
+	return int64(n)
+}
+
+// FillSchedule returns the next n times, after now, at which tokens
+// are added to the bucket, assuming its rate does not change. A
+// quantum of tokens is added at each of them, although tokens that
+// would take the bucket beyond its capacity are dropped.
+func (l *Limiter) FillSchedule(n int) []time.Time {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	return l.fillSchedule(l.now(), n)
+}
+
+// fillSchedule is the internal version of FillSchedule - it takes
+// the current time as an argument to enable easy testing.
+func (l *Limiter) fillSchedule(now time.Time, n int) []time.Time {
+	if n <= 0 {
+		return nil
+	}
+	schedule := make([]time.Time, n)
+	next := l.currentTick(now) + 1
+	for i := range schedule {
+		schedule[i] = l.tickTime(next + int64(i))
+	}
+	return schedule
+}
+
+// TimeToFull returns how long it will take for the bucket to fill
+// to capacity if no more tokens are taken, or zero if it is already
+// full. It concerns the tokens in the bucket rather than those
+// granted, so pacing under WithMaxBurstRate does not affect it.
+func (l *Limiter) TimeToFull() time.Duration {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	return l.accrualTime(l.now(), l.capacity)
+}
+
+// SettledAt returns the time at which the bucket will hold
+// targetAvailable tokens if no more are taken, accruing at its
+// current rate. After SetRate raises the rate, this tells when the
+// bucket has caught up under the new rate. The returned time is not
+// in the past, and is the zero time if the bucket can never hold
+// that many tokens.
+func (l *Limiter) SettledAt(targetAvailable int64) time.Time {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	return l.settledAt(l.now(), targetAvailable)
+}
+
+// settledAt is the internal version of SettledAt - it takes the
+// current time as an argument to enable easy testing.
+func (l *Limiter) settledAt(now time.Time, targetAvailable int64) time.Time {
+	if targetAvailable > l.accrualCap() {
+		return time.Time{}
+	}
+	return now.Add(l.accrualTime(now, targetAvailable))
+}
+
+// TimeToFirstReject offers load to the limiter at offeredPerSec
+// requests per second, each for a single token that must be
+// available immediately, and returns how long it was until the
+// first request was rejected. Requests are paced by sleeping on the
+// limiter's clock, so on a fake clock the result is exact. The
+// tokens are really taken, so it is meant for load-test harnesses
+// rather than limiters in service. If ctx is done before a request
+// is rejected, the returned duration is effectively infinite.
+func (l *Limiter) TimeToFirstReject(ctx context.Context, offeredPerSec float64) time.Duration {
+	if offeredPerSec <= 0 {
+		panic("token bucket offered load is not > 0")
+	}
+	interval := time.Duration(1e9 / offeredPerSec)
+	start := l.now()
+	for i := int64(0); ; i++ {
+		if ctx.Err() != nil {
+			return infinityDuration
+		}
+		at := time.Duration(i) * interval
+		if d := at - l.now().Sub(start); d > 0 {
+			l.clock.Sleep(d)
+		}
+		if _, ok := l.TakeMaxDuration(1, 0); !ok {
+			return l.now().Sub(start)
+		}
+	}
+}
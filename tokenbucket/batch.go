@@ -0,0 +1,135 @@
+package tokenbucket
+
+import (
+	"sort"
+	"time"
+	"unsafe"
+)
+
+// AllowBatch takes the given number of tokens from the Limiter for
+// each key in reqs, if they are available immediately. It returns
+// whether the tokens for each key were available, and whether they
+// were for every key.
+//
+// Keys exempted by the filter given by WithKeyFilter are always
+// allowed. By default each key is treated independently, just as by
+// Allow.
+// If the keyed limiter was created with WithAllOrNothingBatches,
+// tokens are only taken if they are available for every key;
+// otherwise none are taken, and the per-key results show which keys
+// could not be satisfied. Keys that share a Limiter are satisfied
+// only if it has the tokens for all of them together. To make this
+// atomic, the Limiters for all the keys are locked together, each
+// once and in a fixed order so that concurrent batches cannot
+// deadlock.
+func (k *KeyedLimiter) AllowBatch(reqs map[string]int64) (map[string]bool, bool) {
+	results := make(map[string]bool, len(reqs))
+	if !k.allOrNothing {
+		all := true
+		for key, count := range reqs {
+			ok := k.Allow(key, count)
+			results[key] = ok
+			all = all && ok
+		}
+		return results, all
+	}
+
+	keys := make([]string, 0, len(reqs))
+	for key := range reqs {
+		if k.bypasses(key) {
+			results[key] = true
+			continue
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	limiters := make([]*Limiter, len(keys))
+	for i, key := range keys {
+		limiters[i] = k.Get(key)
+	}
+
+	// Outright refusals are decided before any lock is taken, as
+	// they call back into user code.
+	refused := make([]bool, len(keys))
+	floored := make([]bool, len(keys))
+	for i, key := range keys {
+		var err error
+		floored[i], err = limiters[i].refusal(reqs[key], "")
+		refused[i] = err != nil
+	}
+
+	// Keys may share a Limiter, which must then be locked once
+	// and asked for the tokens of all of them together.
+	var distinct []*Limiter
+	totals := make(map[*Limiter]int64, len(limiters))
+	for i, l := range limiters {
+		if _, ok := totals[l]; !ok {
+			distinct = append(distinct, l)
+			totals[l] = 0
+		}
+		if count := reqs[keys[i]]; count > 0 {
+			totals[l] += count
+		}
+	}
+	// Limiters do not move in memory, so their addresses give
+	// every batch the same lock order.
+	sort.Slice(distinct, func(i, j int) bool {
+		return uintptr(unsafe.Pointer(distinct[i])) < uintptr(unsafe.Pointer(distinct[j]))
+	})
+
+	// Work out which keys can be satisfied, holding every lock
+	// until the tokens have been taken.
+	for _, l := range distinct {
+		l.mtx.Lock()
+	}
+	all := true
+	for i, key := range keys {
+		l := limiters[i]
+		ok := !refused[i] && l.canTake(l.now(), totals[l])
+		results[key] = ok
+		all = all && ok
+	}
+	for i, key := range keys {
+		if l := limiters[i]; all {
+			if count := reqs[key]; count > 0 {
+				now := l.now()
+				l.consume(now, now, count)
+				if floored[i] {
+					l.chargeFloor(count)
+				}
+			}
+		} else if !results[key] && !refused[i] {
+			l.reject(reqs[key])
+		}
+	}
+
+	due := make([]dueCallbacks, len(distinct))
+	for i := len(distinct) - 1; i >= 0; i-- {
+		due[i] = distinct[i].release()
+	}
+	for i, l := range distinct {
+		due[i].run(l)
+	}
+	if k.throttled != nil {
+		for _, key := range keys {
+			if !results[key] {
+				k.throttled.record(key)
+			}
+		}
+	}
+	return results, all
+}
+
+// canTake brings the bucket up to date as of now and reports
+// whether count tokens are available and within the lifetime quota.
+// l.mtx must be held.
+func (l *Limiter) canTake(now time.Time, count int64) bool {
+	if count <= 0 {
+		return true
+	}
+	if count > l.quotaLeft() {
+		return false
+	}
+	l.adjustAvailableTokens(l.currentTick(now))
+	return l.availableTokens >= count && !l.pacedAt(now, now, count).After(now)
+}
@@ -0,0 +1,37 @@
+package tokenbucket
+
+import (
+	"math"
+	"time"
+)
+
+// pacedAt returns the earliest time, no earlier than at, at which a
+// take of count tokens made at now may be granted under
+// WithMaxBurstRate. Its tokens are released one every burstInterval,
+// starting no earlier than now or than nextGrant, and the take is
+// granted with the last of them.
+func (l *Limiter) pacedAt(now, at time.Time, count int64) time.Time {
+	if l.burstInterval <= 0 {
+		return at
+	}
+	start := now
+	if start.Before(l.nextGrant) {
+		start = l.nextGrant
+	}
+	if paced := start.Add(l.burstSpan(count)); paced.After(at) {
+		return paced
+	}
+	return at
+}
+
+// burstSpan returns the time it takes to release count tokens under
+// WithMaxBurstRate, from the first of them to the last.
+func (l *Limiter) burstSpan(count int64) time.Duration {
+	if count <= 1 {
+		return 0
+	}
+	if count-1 > math.MaxInt64/int64(l.burstInterval) {
+		return infinityDuration
+	}
+	return time.Duration(count-1) * l.burstInterval
+}
@@ -0,0 +1,105 @@
+package tokenbucket
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// StartCheckpointer writes the state of the bucket, as returned by
+// StateBytes, to the file at path, and then keeps doing so every
+// interval, measured on the limiter's clock, so that the state can be
+// restored with RestoreFromCheckpoint after a crash. Each checkpoint
+// replaces the file atomically, by writing a temporary file in the
+// same directory and renaming it into place.
+//
+// An error writing the first checkpoint is returned, and the
+// checkpointer is not started. Errors writing later checkpoints are
+// ignored, and the write is tried again at the next interval.
+//
+// Calling stop stops the checkpointer, waiting for any checkpoint
+// being written to finish, then writes a final checkpoint and returns
+// the error writing it, if any. Later calls return the same error.
+// The goroutine sleeping on the limiter's clock on behalf of the
+// checkpointer lingers until the interval it is waiting for ends.
+func (l *Limiter) StartCheckpointer(path string, interval time.Duration) (stop func() error, err error) {
+	if interval <= 0 {
+		panic("token bucket checkpoint interval is not > 0")
+	}
+	if err := l.checkpoint(path); err != nil {
+		return nil, err
+	}
+
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		for {
+			slept := make(chan struct{})
+			go func() {
+				l.clock.Sleep(interval)
+				close(slept)
+			}()
+			select {
+			case <-slept:
+				l.checkpoint(path)
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var (
+		once    sync.Once
+		stopErr error
+	)
+	return func() error {
+		once.Do(func() {
+			close(done)
+			<-exited
+			stopErr = l.checkpoint(path)
+		})
+		return stopErr
+	}, nil
+}
+
+// checkpoint atomically replaces the file at path with the state of
+// the bucket.
+func (l *Limiter) checkpoint(path string) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(l.StateBytes()); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
+
+// RestoreFromCheckpoint loads the state written by StartCheckpointer
+// to the file at path, as LoadStateBytes does. The limiter should be
+// configured the same way as the one that wrote the checkpoint.
+func (l *Limiter) RestoreFromCheckpoint(path string) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return l.LoadStateBytes(b)
+}
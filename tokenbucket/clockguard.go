@@ -0,0 +1,45 @@
+package tokenbucket
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// ClockGuard determines what a Limiter does when its clock returns an
+// implausible time: the zero time, or one before the Unix epoch.
+// Left unchecked, such a time would make the limiter compute a huge
+// elapsed time and fill or drain the bucket as a result.
+type ClockGuard int
+
+const (
+	// ClockGuardPanic makes the limiter panic, to surface the
+	// faulty clock. It is the default.
+	ClockGuardPanic ClockGuard = iota
+
+	// ClockGuardClamp makes the limiter use the last plausible
+	// time its clock returned instead, so that no time is taken
+	// to have passed.
+	ClockGuardClamp
+)
+
+// plausibleTime reports whether t is a time a working clock could
+// return.
+func plausibleTime(t time.Time) bool {
+	return !t.IsZero() && t.Unix() >= 0
+}
+
+// guardTime returns t, which was just returned by the limiter's
+// clock, if it is plausible, and otherwise applies the limiter's
+// clock guard.
+func (l *Limiter) guardTime(t time.Time) time.Time {
+	if plausibleTime(t) {
+		if l.clockGuard == ClockGuardClamp {
+			atomic.StoreInt64(&l.lastGoodTime, t.UnixNano())
+		}
+		return t
+	}
+	if l.clockGuard != ClockGuardClamp {
+		panic("token bucket clock returned implausible time " + t.String())
+	}
+	return time.Unix(0, atomic.LoadInt64(&l.lastGoodTime))
+}
@@ -0,0 +1,130 @@
+package tokenbucket
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrPaused is returned by WaitContext when the limiter is paused.
+var ErrPaused = errors.New("tokenbucket: limiter is paused")
+
+// WaitContext is like Wait, except that it stops waiting when ctx is
+// done, returning ctx's error, or when the limiter is paused,
+// returning ErrPaused. If the limiter's admission filter rejects the
+// take, it returns ErrVetoed; if the limiter's penalty bucket is
+// exhausted, it returns ErrPenalized; and if the take would exceed
+// the limiter's lifetime quota, it returns ErrQuotaExhausted. If ctx
+// has a deadline that would pass before the tokens are available, it
+// returns context.DeadlineExceeded straight away without taking them.
+//
+// Tokens taken by a wait that is cut short are not returned to the
+// bucket. With the system clock, a wait that is cut short leaves
+// nothing behind; with any other clock, the goroutine sleeping on it
+// on behalf of such a wait lingers until the wait would have ended.
+func (l *Limiter) WaitContext(ctx context.Context, count int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	floored, err := l.refusal(count, "")
+	if err != nil {
+		return err
+	}
+	now := l.now()
+	maxWait := infinityDuration
+	if deadline, ok := ctx.Deadline(); ok {
+		// The deadline is in system time, whatever the
+		// limiter's clock.
+		maxWait = time.Until(deadline)
+	}
+
+	l.mtx.Lock()
+	if l.paused {
+		l.mtx.Unlock()
+		return ErrPaused
+	}
+	pause := l.pauseChan()
+	exhausted := count > l.quotaLeft()
+	d, ok := l.take(now, count, maxWait)
+	if ok && floored {
+		l.chargeFloor(count)
+	}
+	l.unlock()
+	if exhausted {
+		return ErrQuotaExhausted
+	}
+	if !ok {
+		return context.DeadlineExceeded
+	}
+	if d <= 0 {
+		return nil
+	}
+	return l.sleepContext(ctx, pause, d)
+}
+
+// sleepContext waits for d to pass, as sleep does, but stops
+// waiting when ctx is done, returning ctx's error, or when pause is
+// closed, returning ErrPaused. A nil pause is never closed.
+func (l *Limiter) sleepContext(ctx context.Context, pause <-chan struct{}, d time.Duration) error {
+	var done <-chan time.Time
+	if _, ok := l.clock.(realClock); ok && d >= l.spinThreshold {
+		timer := time.NewTimer(l.timerDuration(d))
+		defer timer.Stop()
+		done = timer.C
+	} else {
+		slept := make(chan time.Time)
+		go func() {
+			l.sleep(d)
+			close(slept)
+		}()
+		done = slept
+	}
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-pause:
+		return ErrPaused
+	}
+}
+
+// Pause pauses the limiter: callers blocked in WaitContext return
+// ErrPaused, as do calls to WaitContext made until Unpause is called.
+// Other methods are not affected and tokens keep accruing.
+func (l *Limiter) Pause() {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if l.paused {
+		return
+	}
+	l.paused = true
+	close(l.pauseChan())
+}
+
+// Unpause undoes the effect of Pause.
+func (l *Limiter) Unpause() {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if !l.paused {
+		return
+	}
+	l.paused = false
+	l.pause = nil
+}
+
+// pauseChan returns the channel that is closed when the limiter
+// is next paused, creating it if necessary.
+func (l *Limiter) pauseChan() chan struct{} {
+	if l.pause == nil {
+		l.pause = make(chan struct{})
+	}
+	return l.pause
+}
+
+// IsPaused reports whether the limiter is paused.
+func (l *Limiter) IsPaused() bool {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	return l.paused
+}
@@ -0,0 +1,63 @@
+package tokenbucket
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrUnknownOp is returned by AllowOp and WaitOp for operations
+// missing from the limiter's cost table.
+var ErrUnknownOp = errors.New("tokenbucket: unknown operation")
+
+// opCost returns the cost of op in the limiter's cost table.
+func (l *Limiter) opCost(op string) (int64, error) {
+	cost, ok := l.costs[op]
+	if !ok {
+		return 0, fmt.Errorf("%w %q", ErrUnknownOp, op)
+	}
+	return cost, nil
+}
+
+// AllowOp takes as many tokens as op costs, according to the cost
+// table given by WithCostTable, if they are available immediately,
+// and reports whether it did. It returns an error wrapping
+// ErrUnknownOp if op is not in the cost table.
+func (l *Limiter) AllowOp(op string) (bool, error) {
+	cost, err := l.opCost(op)
+	if err != nil {
+		return false, err
+	}
+	_, ok := l.TakeMaxDuration(cost, 0)
+	return ok, nil
+}
+
+// WaitOp takes as many tokens as op costs, according to the cost
+// table given by WithCostTable, waiting until they are available.
+// It returns an error wrapping ErrUnknownOp if op is not in the
+// cost table, ErrVetoed if the limiter's admission filter rejects
+// the take, ErrPenalized if the limiter's penalty bucket is
+// exhausted, and ErrQuotaExhausted if the take would exceed the
+// limiter's lifetime quota.
+func (l *Limiter) WaitOp(op string) error {
+	cost, err := l.opCost(op)
+	if err != nil {
+		return err
+	}
+	floored, err := l.refusal(cost, "")
+	if err != nil {
+		return err
+	}
+	l.mtx.Lock()
+	d, ok := l.take(l.now(), cost, infinityDuration)
+	if ok && floored {
+		l.chargeFloor(cost)
+	}
+	l.unlock()
+	if !ok {
+		return ErrQuotaExhausted
+	}
+	if d > 0 {
+		l.sleep(d)
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package tokenbucket
+
+import "fmt"
+
+// DualBucket holds two independent buckets for separate read and
+// write quotas, with a single serialized form.
+// Methods on DualBucket may be called concurrently.
+type DualBucket struct {
+	read, write *Limiter
+}
+
+// NewDualBucket returns a DualBucket made up of the given read and
+// write buckets.
+func NewDualBucket(read, write *Limiter) *DualBucket {
+	if read == nil || write == nil {
+		panic("dual bucket limiter is nil")
+	}
+	return &DualBucket{read: read, write: write}
+}
+
+// Read returns the read bucket.
+func (d *DualBucket) Read() *Limiter {
+	return d.read
+}
+
+// Write returns the write bucket.
+func (d *DualBucket) Write() *Limiter {
+	return d.write
+}
+
+// AllowRead takes count tokens from the read bucket if they are
+// available immediately, and reports whether it did.
+func (d *DualBucket) AllowRead(count int64) bool {
+	_, ok := d.read.TakeMaxDuration(count, 0)
+	return ok
+}
+
+// AllowWrite takes count tokens from the write bucket if they are
+// available immediately, and reports whether it did.
+func (d *DualBucket) AllowWrite(count int64) bool {
+	_, ok := d.write.TakeMaxDuration(count, 0)
+	return ok
+}
+
+// DualStats holds the activity counters of both buckets of a
+// DualBucket.
+type DualStats struct {
+	Read, Write Stats
+}
+
+// Stats returns the activity counters of both buckets.
+func (d *DualBucket) Stats() DualStats {
+	return DualStats{Read: d.read.Stats(), Write: d.write.Stats()}
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler. It encodes the
+// dynamic state of both buckets, as returned by StateBytes.
+func (d *DualBucket) MarshalBinary() ([]byte, error) {
+	return append(d.read.StateBytes(), d.write.StateBytes()...), nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler. It restores
+// the dynamic state of both buckets from the encoding returned by
+// MarshalBinary, leaving their configuration untouched. Neither
+// bucket is changed if the encoding is invalid.
+func (d *DualBucket) UnmarshalBinary(b []byte) error {
+	if len(b) != 2*stateLen {
+		return fmt.Errorf("tokenbucket: dual bucket state is %d bytes long, want %d", len(b), 2*stateLen)
+	}
+	for _, half := range [][]byte{b[:stateLen], b[stateLen:]} {
+		if err := checkStateBytes(half); err != nil {
+			return err
+		}
+	}
+	if err := d.read.LoadStateBytes(b[:stateLen]); err != nil {
+		return err
+	}
+	return d.write.LoadStateBytes(b[stateLen:])
+}
@@ -0,0 +1,60 @@
+package tokenbucket
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"time"
+)
+
+// NewLimiterFromEnv returns a limiter configured by environment
+// variables whose names start with prefix followed by an
+// underscore:
+//
+//	PREFIX_BURST     the capacity of the bucket, which is required
+//	PREFIX_RATE      the rate, in tokens per second, as for
+//	                 NewLimiterWithRate
+//	PREFIX_INTERVAL  the interval at which single tokens are added,
+//	                 in the format of time.ParseDuration, as for
+//	                 NewLimiter
+//
+// Exactly one of PREFIX_RATE and PREFIX_INTERVAL must be set. It
+// returns an error naming the variable if a value is missing or
+// malformed, or if the rate is too low or too high to represent.
+// The options are applied as by the other constructors.
+func NewLimiterFromEnv(prefix string, opts ...Option) (*Limiter, error) {
+	burstVar, rateVar, intervalVar := prefix+"_BURST", prefix+"_RATE", prefix+"_INTERVAL"
+
+	burstStr, ok := os.LookupEnv(burstVar)
+	if !ok {
+		return nil, fmt.Errorf("tokenbucket: %s is not set", burstVar)
+	}
+	capacity, err := strconv.ParseInt(burstStr, 10, 64)
+	if err != nil || capacity <= 0 {
+		return nil, fmt.Errorf("tokenbucket: %s is %q, want a positive integer", burstVar, burstStr)
+	}
+
+	rateStr, haveRate := os.LookupEnv(rateVar)
+	intervalStr, haveInterval := os.LookupEnv(intervalVar)
+	switch {
+	case haveRate && haveInterval:
+		return nil, fmt.Errorf("tokenbucket: only one of %s and %s may be set", rateVar, intervalVar)
+	case haveRate:
+		rate, err := strconv.ParseFloat(rateStr, 64)
+		if err != nil || !(rate >= 1e9/math.MaxInt64) || math.IsInf(rate, 1) {
+			return nil, fmt.Errorf("tokenbucket: %s is %q, want a positive, finite rate", rateVar, rateStr)
+		}
+		if rate > maxRate {
+			return nil, fmt.Errorf("tokenbucket: %s is %q, want a rate of at most %g tokens per second", rateVar, rateStr, maxRate)
+		}
+		return NewLimiterWithRate(rate, capacity, opts...), nil
+	case haveInterval:
+		interval, err := time.ParseDuration(intervalStr)
+		if err != nil || interval <= 0 {
+			return nil, fmt.Errorf("tokenbucket: %s is %q, want a positive duration", intervalVar, intervalStr)
+		}
+		return NewLimiter(interval, capacity, opts...), nil
+	}
+	return nil, fmt.Errorf("tokenbucket: neither %s nor %s is set", rateVar, intervalVar)
+}
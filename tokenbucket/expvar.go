@@ -0,0 +1,25 @@
+package tokenbucket
+
+import "expvar"
+
+// expvarState is the JSON form of a Limiter published by
+// PublishExpvar.
+type expvarState struct {
+	Available int64   `json:"available"`
+	Capacity  int64   `json:"capacity"`
+	Rate      float64 `json:"rate"`
+}
+
+// PublishExpvar publishes l as an expvar named name, so that it is
+// served on /debug/vars. Each read of the variable renders the
+// limiter's current available tokens, capacity and rate as a JSON
+// object. Like expvar.Publish, it panics if name is already in use.
+func PublishExpvar(name string, l *Limiter) {
+	expvar.Publish(name, expvar.Func(func() interface{} {
+		return expvarState{
+			Available: l.Available(),
+			Capacity:  l.Capacity(),
+			Rate:      l.Rate(),
+		}
+	}))
+}
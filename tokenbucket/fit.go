@@ -0,0 +1,97 @@
+package tokenbucket
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+// fitRounds holds the number of bisection rounds FitLimiter uses to
+// narrow down the rate.
+const fitRounds = 64
+
+// minFitRate is just above the lowest rate a Limiter can represent,
+// one token every math.MaxInt64 nanoseconds. FitLimiter never
+// returns a limiter with a lower rate.
+const minFitRate = 1.1e-10
+
+// FitLimiter returns a limiter that would have rejected roughly the
+// fraction targetRejectRate of the requests arriving at the given
+// sample times, had each taken one token without waiting. It is
+// intended for choosing limits from recorded traffic rather than
+// guessing them.
+//
+// A rate and capacity are two unknowns, so the limiter is given the
+// capacity of one second's worth of tokens, as a burst allowance
+// conventionally is, and its rate is found by replaying the samples
+// against candidate limiters. Since the limiter rejects whole
+// requests, the rejection rate achieved is only as fine-grained as
+// the number of samples allows. If even the lowest rate a limiter can
+// have meets the target, a limiter with that rate is returned.
+func FitLimiter(samples []time.Time, targetRejectRate float64) *Limiter {
+	if len(samples) < 2 {
+		panic("fit limiter needs at least two samples")
+	}
+	if targetRejectRate < 0 || targetRejectRate >= 1 {
+		panic("fit limiter target reject rate is not in [0, 1)")
+	}
+	sorted := make([]time.Time, len(samples))
+	copy(sorted, samples)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Before(sorted[j])
+	})
+
+	// Start from the mean arrival rate and double until the
+	// target is met, then bisect between the last two rates.
+	span := sorted[len(sorted)-1].Sub(sorted[0]).Seconds()
+	if span <= 0 {
+		span = 1
+	}
+	lo := minFitRate
+	hi := math.Max(float64(len(sorted))/span, minFitRate)
+	for rejectRate(sorted, hi) > targetRejectRate {
+		lo, hi = hi, hi*2
+		if math.IsInf(hi, 0) {
+			panic("fit limiter cannot meet target reject rate")
+		}
+	}
+	for i := 0; i < fitRounds && hi-lo > hi*RateMargin/10; i++ {
+		mid := (lo + hi) / 2
+		if rejectRate(sorted, mid) > targetRejectRate {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	return NewLimiterWithRate(hi, fitCapacity(hi))
+}
+
+// fitCapacity returns the capacity FitLimiter gives a limiter with
+// the given rate.
+func fitCapacity(rate float64) int64 {
+	return int64(math.Max(1, math.Round(rate)))
+}
+
+// rejectRate returns the fraction of requests arriving at the given
+// sorted times that a limiter with the given rate and the capacity
+// chosen by fitCapacity would reject.
+func rejectRate(sorted []time.Time, rate float64) float64 {
+	l := NewLimiterWithRateAndClock(rate, fitCapacity(rate), fixedClock(sorted[0]))
+	rejected := 0
+	for _, at := range sorted {
+		if _, ok := l.take(at, 1, 0); !ok {
+			rejected++
+		}
+	}
+	return float64(rejected) / float64(len(sorted))
+}
+
+// fixedClock is a Clock that always returns the same time, used to
+// start limiters at a given moment for replaying samples.
+type fixedClock time.Time
+
+func (c fixedClock) Now() time.Time {
+	return time.Time(c)
+}
+
+func (fixedClock) Sleep(time.Duration) {}
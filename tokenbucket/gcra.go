@@ -0,0 +1,146 @@
+package tokenbucket
+
+import (
+	"sync"
+	"time"
+)
+
+// gcraMinSlots holds the initial size of a GCRAStore's table.
+const gcraMinSlots = 64
+
+// GCRAStore limits each of a very large number of keys to the same
+// rate and burst, using the generic cell rate algorithm (GCRA).
+// Rather than a Limiter per key, it keeps a single timestamp per
+// key, the key's theoretical arrival time, in a flat open-addressed
+// hash table, so it needs a small fraction of the memory of a
+// KeyedLimiter.
+//
+// Keys are identified by their 64-bit FNV-1a hash alone, so two keys
+// whose hashes collide share a limit. Keys whose timestamp has passed
+// are in the same state as unseen keys and are dropped whenever the
+// table is rebuilt.
+// Methods on GCRAStore may be called concurrently.
+type GCRAStore struct {
+	clock Clock
+	// base holds the time timestamps are measured from.
+	base time.Time
+	// interval holds the time between tokens, and
+	// burstOffset the time burst tokens take, both in
+	// nanoseconds.
+	interval    int64
+	burstOffset int64
+
+	// mtx guards the fields below it.
+	mtx   sync.Mutex
+	slots []gcraSlot
+	// used holds the number of occupied slots.
+	used int
+}
+
+// gcraSlot holds the hash of a key, or zero if the slot is empty,
+// and the key's theoretical arrival time.
+type gcraSlot struct {
+	hash uint64
+	tat  int64
+}
+
+// NewGCRAStore returns a store that allows each key rate events per
+// second, in bursts of up to burst events. If clock is nil, the
+// system clock will be used.
+func NewGCRAStore(rate float64, burst int64, clock Clock) *GCRAStore {
+	if rate <= 0 {
+		panic("gcra store rate is not > 0")
+	}
+	if burst <= 0 {
+		panic("gcra store burst is not > 0")
+	}
+	if clock == nil {
+		clock = realClock{}
+	}
+	interval := int64(1e9 / rate)
+	if interval <= 0 {
+		panic("gcra store rate is too high")
+	}
+	return &GCRAStore{
+		clock:       clock,
+		base:        clock.Now(),
+		interval:    interval,
+		burstOffset: burst * interval,
+		slots:       make([]gcraSlot, gcraMinSlots),
+	}
+}
+
+// Allow reports whether an event for key is allowed now, recording
+// it if so. If not, it also returns how long until it would be.
+func (s *GCRAStore) Allow(key string) (bool, time.Duration) {
+	h := fnv64a(key)
+	if h == 0 {
+		h = 1
+	}
+	now := int64(s.clock.Now().Sub(s.base))
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	slot := s.find(h)
+	tat := now
+	if slot.hash == h && slot.tat > now {
+		tat = slot.tat
+	}
+	tat += s.interval
+	if allowAt := tat - s.burstOffset; allowAt > now {
+		return false, time.Duration(allowAt - now)
+	}
+	if slot.hash == 0 {
+		slot.hash = h
+		s.used++
+	}
+	slot.tat = tat
+	if s.used*4 >= len(s.slots)*3 {
+		s.rebuild(now)
+	}
+	return true, 0
+}
+
+// Len returns the number of keys held in the table, including keys
+// whose timestamp has passed but which have not been dropped yet.
+func (s *GCRAStore) Len() int {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.used
+}
+
+// find returns the slot holding hash h, or the empty slot where it
+// would be inserted.
+func (s *GCRAStore) find(h uint64) *gcraSlot {
+	mask := uint64(len(s.slots) - 1)
+	for i := h & mask; ; i = (i + 1) & mask {
+		if slot := &s.slots[i]; slot.hash == h || slot.hash == 0 {
+			return slot
+		}
+	}
+}
+
+// rebuild drops the keys whose timestamp has passed by now and
+// rehashes the rest into a table sized for them.
+func (s *GCRAStore) rebuild(now int64) {
+	live := 0
+	for _, slot := range s.slots {
+		if slot.hash != 0 && slot.tat > now {
+			live++
+		}
+	}
+	size := gcraMinSlots
+	for size < live*2 {
+		size *= 2
+	}
+
+	old := s.slots
+	s.slots = make([]gcraSlot, size)
+	s.used = 0
+	for _, slot := range old {
+		if slot.hash != 0 && slot.tat > now {
+			*s.find(slot.hash) = slot
+			s.used++
+		}
+	}
+}
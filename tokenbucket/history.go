@@ -0,0 +1,124 @@
+package tokenbucket
+
+import "time"
+
+// takeEvent records a successful take.
+type takeEvent struct {
+	// taken and at hold the times, in Unix nanoseconds, at
+	// which the take was made and at which its tokens were
+	// granted, which is later if it had to wait.
+	taken int64
+	at    int64
+	count int64
+}
+
+// takeHistory is a ring buffer holding the most recent takes.
+type takeHistory struct {
+	events []takeEvent
+	// next holds the index the next event is stored at.
+	next int
+	full bool
+}
+
+func newTakeHistory(size int) *takeHistory {
+	if size <= 0 {
+		panic("token bucket take history size is not > 0")
+	}
+	return &takeHistory{events: make([]takeEvent, size)}
+}
+
+// add records e, replacing the oldest event if the buffer is full.
+func (h *takeHistory) add(e takeEvent) {
+	h.events[h.next] = e
+	h.next++
+	if h.next == len(h.events) {
+		h.next = 0
+		h.full = true
+	}
+}
+
+// each calls fn for each recorded event, most recent first, until
+// fn returns false.
+func (h *takeHistory) each(fn func(e takeEvent) bool) {
+	n := h.next
+	if h.full {
+		n = len(h.events)
+	}
+	for i := 1; i <= n; i++ {
+		j := h.next - i
+		if j < 0 {
+			j += len(h.events)
+		}
+		if !fn(h.events[j]) {
+			return
+		}
+	}
+}
+
+// TakeHistogram returns the number of tokens taken in each of the
+// last numBuckets periods of length bucketDuration, oldest first,
+// with the last period ending now. Each period excludes its start
+// and includes its end. Tokens count towards the period
+// in which they were granted, so tokens still being waited for are
+// not counted yet. Takes are only recorded if the limiter was
+// created with WithTakeHistory, and only as many as it holds, so
+// older periods may be undercounted. Without the option it returns
+// nil.
+func (l *Limiter) TakeHistogram(bucketDuration time.Duration, numBuckets int) []int64 {
+	if bucketDuration <= 0 || numBuckets <= 0 {
+		return nil
+	}
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if l.history == nil {
+		return nil
+	}
+	now := l.now().UnixNano()
+	from := now - int64(bucketDuration)*int64(numBuckets)
+	counts := make([]int64, numBuckets)
+	l.history.each(func(e takeEvent) bool {
+		if e.at <= from {
+			return false
+		}
+		if e.at <= now {
+			counts[(e.at-from-1)/int64(bucketDuration)] += e.count
+		}
+		return true
+	})
+	return counts
+}
+
+// BlockRatio returns the fraction of the successful takes made in
+// the trailing window that had to wait for their tokens, in the
+// range [0, 1], or zero if there were none. It shows how often
+// callers of Wait and the like are held up, where nothing is
+// rejected. Takes are only recorded if the limiter was created with
+// WithTakeHistory, and only as many as it holds, so for long windows
+// only the most recent takes are counted.
+func (l *Limiter) BlockRatio(window time.Duration) float64 {
+	if window <= 0 {
+		return 0
+	}
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if l.history == nil {
+		return 0
+	}
+	now := l.now().UnixNano()
+	from := now - int64(window)
+	var takes, blocked int
+	l.history.each(func(e takeEvent) bool {
+		if e.taken <= from {
+			return false
+		}
+		takes++
+		if e.at > e.taken {
+			blocked++
+		}
+		return true
+	})
+	if takes == 0 {
+		return 0
+	}
+	return float64(blocked) / float64(takes)
+}
@@ -0,0 +1,36 @@
+package tokenbucket
+
+import "net/http"
+
+// roundTripper is an http.RoundTripper that waits for a token
+// before each request.
+type roundTripper struct {
+	rt http.RoundTripper
+	l  *Limiter
+}
+
+// NewRoundTripper returns an http.RoundTripper that takes a token
+// from l, waiting for it if necessary, before passing each request
+// on to rt, so that outbound requests respect the limiter's rate.
+// If rt is nil, http.DefaultTransport is used.
+//
+// The wait honours the request's context: if the context is done
+// before a token is available, the request is not sent and the
+// context's error is returned.
+func NewRoundTripper(rt http.RoundTripper, l *Limiter) http.RoundTripper {
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	return roundTripper{rt: rt, l: l}
+}
+
+// RoundTrip implements http.RoundTripper.RoundTrip.
+func (t roundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := t.l.WaitContext(req.Context(), 1); err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+	return t.rt.RoundTrip(req)
+}
@@ -0,0 +1,68 @@
+package tokenbucket
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRoundTripper(t *testing.T) {
+	var (
+		mtx   sync.Mutex
+		times []time.Time
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mtx.Lock()
+		times = append(times, time.Now())
+		mtx.Unlock()
+	}))
+	defer srv.Close()
+
+	const interval = 50 * time.Millisecond
+	client := &http.Client{Transport: NewRoundTripper(nil, NewLimiter(interval, 1))}
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := client.Get(srv.URL)
+			if err != nil {
+				t.Errorf("request failed: %v", err)
+				return
+			}
+			resp.Body.Close()
+		}()
+	}
+	wg.Wait()
+
+	sort.Slice(times, func(i, j int) bool {
+		return times[i].Before(times[j])
+	})
+	if len(times) != 5 {
+		t.Fatalf("server got %d requests, want 5", len(times))
+	}
+	for i := 1; i < len(times); i++ {
+		if d := times[i].Sub(times[i-1]); d < interval-10*time.Millisecond {
+			t.Fatalf("requests %d and %d spaced by %v, want about %v", i-1, i, d, interval)
+		}
+	}
+
+	l := NewLimiter(time.Hour, 1)
+	l.Take(1)
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewRoundTripper(nil, l).RoundTrip(req); err != context.Canceled {
+		t.Fatalf("queued request: got error %v, want %v", err, context.Canceled)
+	}
+	if len(times) != 5 {
+		t.Fatalf("queued request was sent")
+	}
+}
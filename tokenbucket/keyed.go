@@ -0,0 +1,159 @@
+package tokenbucket
+
+import "sync"
+
+// defaultKeyedShards holds the number of shards used by NewKeyedLimiter.
+const defaultKeyedShards = 32
+
+// KeyedLimiter holds a separate Limiter for each key, created on
+// first use. Keys are spread over a fixed number of shards, each
+// with its own map and mutex, so that callers using distinct keys
+// rarely contend with each other.
+// Methods on KeyedLimiter may be called concurrently.
+type KeyedLimiter struct {
+	newLimiter func(key string) *Limiter
+	shards     []keyedShard
+
+	// throttled tracks the keys rejected most often,
+	// if enabled.
+	throttled *throttleTracker
+
+	// allOrNothing makes AllowBatch take tokens for all
+	// keys or none.
+	allOrNothing bool
+
+	// filter, if set, holds the keys that are limited; others
+	// bypass Allow and AllowBatch.
+	filter *KeyFilter
+}
+
+// bypasses reports whether key is exempt from limiting because the
+// key filter does not contain it.
+func (k *KeyedLimiter) bypasses(key string) bool {
+	return k.filter != nil && !k.filter.MayContain(key)
+}
+
+type keyedShard struct {
+	// mtx guards limiters.
+	mtx      sync.Mutex
+	limiters map[string]*Limiter
+}
+
+// NewKeyedLimiter returns a new keyed limiter that calls newLimiter
+// to create the Limiter for a key the first time it is used.
+func NewKeyedLimiter(newLimiter func(key string) *Limiter, opts ...KeyedOption) *KeyedLimiter {
+	return NewKeyedLimiterWithShards(newLimiter, defaultKeyedShards, opts...)
+}
+
+// NewKeyedLimiterWithShards is like NewKeyedLimiter, but allows the
+// specification of the number of shards the keys are spread over.
+func NewKeyedLimiterWithShards(newLimiter func(key string) *Limiter, shards int, opts ...KeyedOption) *KeyedLimiter {
+	if newLimiter == nil {
+		panic("keyed limiter constructor is nil")
+	}
+	if shards <= 0 {
+		panic("keyed limiter shard count is not > 0")
+	}
+	k := &KeyedLimiter{
+		newLimiter: newLimiter,
+		shards:     make([]keyedShard, shards),
+	}
+	for i := range k.shards {
+		k.shards[i].limiters = make(map[string]*Limiter)
+	}
+	for _, opt := range opts {
+		opt.apply(k)
+	}
+	return k
+}
+
+// shard returns the shard that holds key, selected by the
+// 32-bit FNV-1a hash of the key.
+func (k *KeyedLimiter) shard(key string) *keyedShard {
+	const (
+		offset32 = 2166136261
+		prime32  = 16777619
+	)
+	h := uint32(offset32)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= prime32
+	}
+	return &k.shards[h%uint32(len(k.shards))]
+}
+
+// Get returns the Limiter for key, creating it if necessary.
+func (k *KeyedLimiter) Get(key string) *Limiter {
+	s := k.shard(key)
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	l, ok := s.limiters[key]
+	if !ok {
+		l = k.newLimiter(key)
+		s.limiters[key] = l
+	}
+	return l
+}
+
+// Allow takes count tokens from the Limiter for key if they are
+// available immediately, and reports whether it did. Keys exempted
+// by the filter given by WithKeyFilter are always allowed.
+func (k *KeyedLimiter) Allow(key string, count int64) bool {
+	if k.bypasses(key) {
+		return true
+	}
+	if _, ok := k.Get(key).TakeMaxDuration(count, 0); ok {
+		return true
+	}
+	if k.throttled != nil {
+		k.throttled.record(key)
+	}
+	return false
+}
+
+// Delete removes the Limiter for key, if any. A later call to Get
+// with the same key creates a fresh Limiter.
+func (k *KeyedLimiter) Delete(key string) {
+	s := k.shard(key)
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	delete(s.limiters, key)
+}
+
+// Len returns the number of keys that currently have a Limiter.
+func (k *KeyedLimiter) Len() int {
+	n := 0
+	for i := range k.shards {
+		s := &k.shards[i]
+		s.mtx.Lock()
+		n += len(s.limiters)
+		s.mtx.Unlock()
+	}
+	return n
+}
+
+// Range calls fn for each key and its Limiter until fn returns
+// false. Each shard is copied before fn is called on its entries,
+// so fn may safely call other methods on k. Keys added or removed
+// concurrently may or may not be visited.
+func (k *KeyedLimiter) Range(fn func(key string, l *Limiter) bool) {
+	type entry struct {
+		key string
+		l   *Limiter
+	}
+	var entries []entry
+	for i := range k.shards {
+		s := &k.shards[i]
+		entries = entries[:0]
+		s.mtx.Lock()
+		for key, l := range s.limiters {
+			entries = append(entries, entry{key, l})
+		}
+		s.mtx.Unlock()
+		for _, e := range entries {
+			if !fn(e.key, e.l) {
+				return
+			}
+		}
+	}
+}
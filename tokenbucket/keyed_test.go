@@ -0,0 +1,401 @@
+package tokenbucket
+
+import (
+	"github.com/andres-erbsen/clock"
+	"math/rand"
+	"reflect"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestKeyedLimiter(shards int) *KeyedLimiter {
+	return NewKeyedLimiterWithShards(func(string) *Limiter {
+		return NewLimiter(time.Millisecond, 10)
+	}, shards)
+}
+
+func TestKeyedLimiter(t *testing.T) {
+	k := newTestKeyedLimiter(4)
+	for i := 0; i < 100; i++ {
+		key := strconv.Itoa(i)
+		if l := k.Get(key); l != k.Get(key) {
+			t.Fatalf("key %s: got different limiters for the same key", key)
+		}
+	}
+	if n := k.Len(); n != 100 {
+		t.Fatalf("len = %d, want = %d", n, 100)
+	}
+
+	seen := make(map[string]bool)
+	k.Range(func(key string, l *Limiter) bool {
+		if l != k.Get(key) {
+			t.Fatalf("key %s: range limiter differs from Get", key)
+		}
+		seen[key] = true
+		return true
+	})
+	if len(seen) != 100 {
+		t.Fatalf("range visited %d keys, want = %d", len(seen), 100)
+	}
+
+	visited := 0
+	k.Range(func(string, *Limiter) bool {
+		visited++
+		return visited < 10
+	})
+	if visited != 10 {
+		t.Fatalf("range visited %d keys after stop, want = %d", visited, 10)
+	}
+
+	k.Delete("0")
+	if n := k.Len(); n != 99 {
+		t.Fatalf("after delete: len = %d, want = %d", n, 99)
+	}
+}
+
+func BenchmarkKeyedLimiter(b *testing.B) {
+	for _, shards := range []int{1, defaultKeyedShards} {
+		b.Run("shards:"+strconv.Itoa(shards), func(b *testing.B) {
+			k := newTestKeyedLimiter(shards)
+			var next int64
+			b.RunParallel(func(pb *testing.PB) {
+				base := atomic.AddInt64(&next, 1) << 20
+				var i int64
+				for pb.Next() {
+					k.Get(strconv.FormatInt(base+i%4096, 10)).TakeAvailable(1)
+					i++
+				}
+			})
+		})
+	}
+}
+
+func TestTopThrottled(t *testing.T) {
+	mock := clock.NewMock()
+	k := NewKeyedLimiter(func(string) *Limiter {
+		return NewLimiterWithClock(time.Hour, 1, mock)
+	}, WithThrottleTracking(time.Minute, mock))
+
+	rng := rand.New(rand.NewSource(1))
+	hot := map[string]bool{"hot0": true, "hot1": true, "hot2": true, "hot3": true, "hot4": true}
+	for i := 0; i < 20000; i++ {
+		key := "cold" + strconv.Itoa(rng.Intn(5000))
+		if rng.Intn(10) == 0 {
+			key = "hot" + strconv.Itoa(rng.Intn(len(hot)))
+		}
+		k.Allow(key, 1)
+	}
+
+	top := k.TopThrottled(len(hot))
+	if len(top) != len(hot) {
+		t.Fatalf("got %d top keys, want %d", len(top), len(hot))
+	}
+	for i, kc := range top {
+		if !hot[kc.Key] {
+			t.Fatalf("top key %d is %q with count %d, want one of the hot keys", i, kc.Key, kc.Count)
+		}
+		if i > 0 && kc.Count > top[i-1].Count {
+			t.Fatalf("top keys out of order: %v", top)
+		}
+	}
+
+	for _, n := range []int{0, -1} {
+		if top := k.TopThrottled(n); top != nil {
+			t.Fatalf("TopThrottled(%d) = %v, want nil", n, top)
+		}
+	}
+
+	mock.Add(2 * time.Minute)
+	if top := k.TopThrottled(len(hot)); len(top) != 0 {
+		t.Fatalf("after window: got top keys %v, want none", top)
+	}
+	if top := newTestKeyedLimiter(1).TopThrottled(1); top != nil {
+		t.Fatalf("without tracking: got top keys %v, want nil", top)
+	}
+}
+
+// refGCRA is a straightforward GCRA keyed by a map, used to check
+// GCRAStore.
+type refGCRA struct {
+	interval, burst time.Duration
+	tat             map[string]time.Time
+}
+
+func (r *refGCRA) allow(key string, now time.Time) (bool, time.Duration) {
+	tat := r.tat[key]
+	if tat.Before(now) {
+		tat = now
+	}
+	tat = tat.Add(r.interval)
+	if allowAt := tat.Add(-r.burst); allowAt.After(now) {
+		return false, allowAt.Sub(now)
+	}
+	r.tat[key] = tat
+	return true, 0
+}
+
+func TestGCRAStore(t *testing.T) {
+	c := newFakeClock()
+	s := NewGCRAStore(100, 5, c)
+	ref := &refGCRA{
+		interval: 10 * time.Millisecond,
+		burst:    50 * time.Millisecond,
+		tat:      make(map[string]time.Time),
+	}
+
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 100000; i++ {
+		key := "key" + strconv.Itoa(rng.Intn(500))
+		ok, wait := s.Allow(key)
+		refOK, refWait := ref.allow(key, c.Now())
+		if ok != refOK || wait != refWait {
+			t.Fatalf("step %d, key %s: got (%v, %v), want (%v, %v)", i, key, ok, wait, refOK, refWait)
+		}
+		c.Sleep(time.Duration(rng.Intn(100)) * time.Microsecond)
+	}
+
+	c.Sleep(time.Second)
+	for i := 0; i < 1000; i++ {
+		s.Allow("fresh" + strconv.Itoa(i))
+	}
+	if n := s.Len(); n > 1000+gcraMinSlots {
+		t.Fatalf("len = %d after expiry, want expired keys dropped", n)
+	}
+}
+
+func BenchmarkKeyedMemory(b *testing.B) {
+	const keys = 100000
+	measure := func(b *testing.B, fill func()) {
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+		fill()
+		runtime.GC()
+		runtime.ReadMemStats(&after)
+		b.ReportMetric(float64(after.HeapAlloc-before.HeapAlloc)/keys, "bytes/key")
+	}
+	b.Run("KeyedLimiter", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			var k *KeyedLimiter
+			measure(b, func() {
+				k = newTestKeyedLimiter(defaultKeyedShards)
+				for j := 0; j < keys; j++ {
+					k.Get(strconv.Itoa(j)).TakeAvailable(1)
+				}
+			})
+			runtime.KeepAlive(k)
+		}
+	})
+	b.Run("GCRAStore", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			var s *GCRAStore
+			measure(b, func() {
+				s = NewGCRAStore(1, 10, nil)
+				for j := 0; j < keys; j++ {
+					s.Allow(strconv.Itoa(j))
+				}
+			})
+			runtime.KeepAlive(s)
+		}
+	})
+}
+
+func TestAllowBatch(t *testing.T) {
+	newLimiter := func(string) *Limiter {
+		return NewLimiterWithClock(time.Hour, 5, newFakeClock())
+	}
+	reqs := map[string]int64{"a": 3, "b": 3, "c": 6}
+	wantResults := map[string]bool{"a": true, "b": true, "c": false}
+
+	k := NewKeyedLimiter(newLimiter)
+	results, all := k.AllowBatch(reqs)
+	if all || !reflect.DeepEqual(results, wantResults) {
+		t.Fatalf("independent: got %v, %v; want %v, false", results, all, wantResults)
+	}
+	for key, want := range map[string]int64{"a": 2, "b": 2, "c": 5} {
+		if avail := k.Get(key).Available(); avail != want {
+			t.Fatalf("independent: key %s has %d available, want %d", key, avail, want)
+		}
+	}
+
+	k = NewKeyedLimiter(newLimiter, WithAllOrNothingBatches())
+	results, all = k.AllowBatch(reqs)
+	if all || !reflect.DeepEqual(results, wantResults) {
+		t.Fatalf("all or nothing: got %v, %v; want %v, false", results, all, wantResults)
+	}
+	for key := range reqs {
+		if avail := k.Get(key).Available(); avail != 5 {
+			t.Fatalf("all or nothing: key %s has %d available after failed batch, want 5", key, avail)
+		}
+	}
+	reqs["c"] = 5
+	results, all = k.AllowBatch(reqs)
+	if !all {
+		t.Fatalf("all or nothing: got %v, %v; want all allowed", results, all)
+	}
+	for key, want := range map[string]int64{"a": 2, "b": 2, "c": 0} {
+		if avail := k.Get(key).Available(); avail != want {
+			t.Fatalf("all or nothing: key %s has %d available, want %d", key, avail, want)
+		}
+	}
+}
+
+func TestAllowBatchCallbacks(t *testing.T) {
+	// The admission filter for "b" looks at the Limiter for "a",
+	// which would deadlock if it ran with that Limiter locked.
+	var k *KeyedLimiter
+	k = NewKeyedLimiter(func(key string) *Limiter {
+		var opts []Option
+		if key == "b" {
+			opts = append(opts, WithAdmissionFilter(func(int64) bool {
+				return k.Get("a").Available() > 4
+			}))
+		}
+		return NewLimiterWithClock(time.Hour, 5, newFakeClock(), opts...)
+	}, WithAllOrNothingBatches())
+	k.Get("a")
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if _, all := k.AllowBatch(map[string]int64{"a": 1, "b": 1}); !all {
+			t.Errorf("first batch refused")
+		}
+		if results, all := k.AllowBatch(map[string]int64{"a": 1, "b": 1}); all || results["b"] {
+			t.Errorf("second batch: got %v, %v; want b vetoed", results, all)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("AllowBatch deadlocked")
+	}
+	if avail := k.Get("a").Available(); avail != 4 {
+		t.Fatalf("a has %d available, want 4", avail)
+	}
+}
+
+func TestAllowBatchSharedLimiter(t *testing.T) {
+	// Keys "a" and "z" share a Limiter, so a batch holding it
+	// and the Limiter for "m" locks them in a different key
+	// order from one holding "m" and "z".
+	shared := NewLimiterWithClock(time.Hour, 1000, newFakeClock())
+	k := NewKeyedLimiter(func(key string) *Limiter {
+		if key == "a" || key == "z" {
+			return shared
+		}
+		return NewLimiterWithClock(time.Hour, 1000, newFakeClock())
+	}, WithAllOrNothingBatches())
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if _, all := k.AllowBatch(map[string]int64{"a": 1, "z": 2}); !all {
+			t.Errorf("batch on shared limiter refused")
+		}
+		var wg sync.WaitGroup
+		for _, reqs := range []map[string]int64{{"a": 1, "m": 1}, {"m": 1, "z": 1}} {
+			reqs := reqs
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < 200; i++ {
+					k.AllowBatch(reqs)
+				}
+			}()
+		}
+		wg.Wait()
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("AllowBatch deadlocked")
+	}
+	if avail := shared.Available(); avail != 597 {
+		t.Fatalf("shared limiter has %d available, want 597", avail)
+	}
+
+	// The shared Limiter must have the tokens for both keys at once.
+	results, all := k.AllowBatch(map[string]int64{"a": 300, "z": 300})
+	if all || results["a"] || results["z"] {
+		t.Fatalf("oversized batch on shared limiter: got %v, %v; want both refused", results, all)
+	}
+	if avail := shared.Available(); avail != 597 {
+		t.Fatalf("refused batch took tokens: shared limiter has %d available, want 597", avail)
+	}
+}
+
+func TestAllowBatchConcurrent(t *testing.T) {
+	k := NewKeyedLimiter(func(string) *Limiter {
+		return NewLimiterWithClock(time.Hour, 1000, newFakeClock())
+	}, WithAllOrNothingBatches())
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				k.AllowBatch(map[string]int64{
+					strconv.Itoa(i % 3):       1,
+					strconv.Itoa((i + 1) % 3): 1,
+				})
+			}
+		}()
+	}
+	wg.Wait()
+	total := int64(0)
+	for i := 0; i < 3; i++ {
+		total += 1000 - k.Get(strconv.Itoa(i)).Available()
+	}
+	if total%2 != 0 {
+		t.Fatalf("%d tokens taken in total, want an even number", total)
+	}
+}
+
+func TestKeyFilter(t *testing.T) {
+	filter := NewKeyFilter(100, 0.01)
+	for i := 0; i < 100; i++ {
+		filter.Add("tracked" + strconv.Itoa(i))
+	}
+	k := NewKeyedLimiter(func(string) *Limiter {
+		return NewLimiterWithClock(time.Hour, 1, newFakeClock())
+	}, WithKeyFilter(filter))
+
+	for i := 0; i < 100; i++ {
+		key := "tracked" + strconv.Itoa(i)
+		if !filter.MayContain(key) {
+			t.Fatalf("filter lost key %s", key)
+		}
+		if !k.Allow(key, 1) || k.Allow(key, 1) {
+			t.Fatalf("tracked key %s not limited", key)
+		}
+	}
+
+	bypassed := 0
+	for i := 0; i < 1000; i++ {
+		key := "untracked" + strconv.Itoa(i)
+		if k.Allow(key, 1) && k.Allow(key, 1) {
+			bypassed++
+		}
+	}
+	if bypassed < 950 {
+		t.Fatalf("%d of 1000 untracked keys bypassed limiting, want nearly all", bypassed)
+	}
+	if n := k.Len(); n > 100+1000-bypassed {
+		t.Fatalf("%d limiters created, want only those for limited keys", n)
+	}
+
+	untracked := "untracked0"
+	for i := 1; filter.MayContain(untracked); i++ {
+		untracked = "untracked" + strconv.Itoa(i)
+	}
+	results, all := k.AllowBatch(map[string]int64{"tracked0": 1, untracked: 5})
+	if all || results["tracked0"] || !results[untracked] {
+		t.Fatalf("batch results %v, %v; want tracked key limited and untracked key bypassed", results, all)
+	}
+}
@@ -0,0 +1,75 @@
+package tokenbucket
+
+import (
+	"math"
+	"sync/atomic"
+)
+
+// KeyFilter is a Bloom filter holding a set of keys. It can report
+// that a key is definitely not in the set, but may report that keys
+// added to it are not the only ones it holds: a key that was never
+// added is reported as possibly present at the false positive rate
+// the filter was sized for.
+// Methods on KeyFilter may be called concurrently.
+type KeyFilter struct {
+	bits   []uint64
+	hashes int
+}
+
+// NewKeyFilter returns an empty filter sized to hold the expected
+// number of keys with the given false positive rate, which must lie
+// strictly between zero and one.
+func NewKeyFilter(expected int, falsePositiveRate float64) *KeyFilter {
+	if expected <= 0 {
+		panic("key filter expected key count is not > 0")
+	}
+	if falsePositiveRate <= 0 || falsePositiveRate >= 1 {
+		panic("key filter false positive rate is not in (0, 1)")
+	}
+	bits := math.Ceil(-float64(expected) * math.Log(falsePositiveRate) / (math.Ln2 * math.Ln2))
+	hashes := int(math.Round(bits / float64(expected) * math.Ln2))
+	if hashes < 1 {
+		hashes = 1
+	}
+	return &KeyFilter{
+		bits:   make([]uint64, (int(bits)+63)/64),
+		hashes: hashes,
+	}
+}
+
+// positions calls fn with the index of each bit for key, derived
+// from its 64-bit FNV-1a hash by double hashing.
+func (f *KeyFilter) positions(key string, fn func(word int, mask uint64) bool) {
+	h := fnv64a(key)
+	h1, h2 := h&0xffffffff, h>>32|1
+	n := uint64(len(f.bits)) * 64
+	for i := 0; i < f.hashes; i++ {
+		bit := (h1 + uint64(i)*h2) % n
+		if !fn(int(bit/64), 1<<(bit%64)) {
+			return
+		}
+	}
+}
+
+// Add adds key to the set.
+func (f *KeyFilter) Add(key string) {
+	f.positions(key, func(word int, mask uint64) bool {
+		for {
+			old := atomic.LoadUint64(&f.bits[word])
+			if old&mask != 0 || atomic.CompareAndSwapUint64(&f.bits[word], old, old|mask) {
+				return true
+			}
+		}
+	})
+}
+
+// MayContain reports whether key may be in the set. If it reports
+// false, key has definitely not been added.
+func (f *KeyFilter) MayContain(key string) bool {
+	present := true
+	f.positions(key, func(word int, mask uint64) bool {
+		present = atomic.LoadUint64(&f.bits[word])&mask != 0
+		return present
+	})
+	return present
+}
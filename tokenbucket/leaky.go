@@ -0,0 +1,44 @@
+package tokenbucket
+
+import "time"
+
+// TokenToLeaky returns the parameters of a leaky bucket limiter, as
+// created by leakybucket.New(rate, leakybucket.WithPer(per),
+// leakybucket.WithSlack(slack)), equivalent to a token bucket that
+// gains a token every fillInterval up to the given capacity.
+//
+// The two limiters have exactly the same average rate, and after
+// being idle both let the same number of requests through at once.
+// They differ in the short term: the token bucket credits whole
+// tokens at tick boundaries while the leaky bucket credits slack
+// continuously, and a new leaky bucket starts with no slack while a
+// new token bucket starts full.
+func TokenToLeaky(fillInterval time.Duration, capacity int64) (rate int, per time.Duration, slack int) {
+	if fillInterval <= 0 {
+		panic("token bucket fill interval is not > 0")
+	}
+	if capacity <= 0 {
+		panic("token bucket capacity is not > 0")
+	}
+	return 1, fillInterval, int(capacity - 1)
+}
+
+// LeakyToToken returns the fill interval and capacity of a token
+// bucket equivalent to a leaky bucket limiter allowing rate requests
+// per period per, with the given slack. It is the inverse of
+// TokenToLeaky, and the equivalence is exact and approximate in the
+// same ways. The leaky bucket spaces requests per/rate apart, rounded
+// down to the nanosecond, and so does the token bucket.
+func LeakyToToken(rate int, per time.Duration, slack int) (fillInterval time.Duration, capacity int64) {
+	if rate <= 0 {
+		panic("leaky bucket rate is not > 0")
+	}
+	if slack < 0 {
+		panic("leaky bucket slack is negative")
+	}
+	fillInterval = per / time.Duration(rate)
+	if fillInterval <= 0 {
+		panic("leaky bucket per-request interval is not > 0")
+	}
+	return fillInterval, int64(slack) + 1
+}
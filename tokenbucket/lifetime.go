@@ -0,0 +1,19 @@
+package tokenbucket
+
+import (
+	"errors"
+	"math"
+)
+
+// ErrQuotaExhausted is returned by WaitContext and WaitOp when a take
+// would exceed the limiter's lifetime quota.
+var ErrQuotaExhausted = errors.New("tokenbucket: lifetime quota exhausted")
+
+// quotaLeft returns how many more tokens the lifetime quota given
+// by WithLifetimeQuota allows to be granted. l.mtx must be held.
+func (l *Limiter) quotaLeft() int64 {
+	if l.lifetimeQuota <= 0 {
+		return math.MaxInt64
+	}
+	return l.lifetimeQuota - l.stats.Granted
+}
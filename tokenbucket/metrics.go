@@ -0,0 +1,37 @@
+package tokenbucket
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// WriteMetrics writes the state and activity counters of l to w in
+// the Prometheus text exposition format, so that they can be served
+// from a plain http.HandlerFunc without the Prometheus client
+// library. The metrics are taken as of a single instant and are
+// named with the prefix tokenbucket_.
+func (l *Limiter) WriteMetrics(w io.Writer) error {
+	v := l.View()
+	var buf bytes.Buffer
+	for _, m := range []struct {
+		name, kind, help string
+		value            float64
+	}{
+		{"available_tokens", "gauge", "Tokens available, negative while takes wait for reserved tokens.", float64(v.Available)},
+		{"capacity_tokens", "gauge", "Capacity of the bucket.", float64(v.Capacity)},
+		{"rate_tokens_per_second", "gauge", "Rate at which the bucket fills.", v.Rate},
+		{"takes_total", "counter", "Takes granted tokens.", float64(v.Stats.Takes)},
+		{"granted_tokens_total", "counter", "Tokens granted.", float64(v.Stats.Granted)},
+		{"rejected_total", "counter", "Takes refused tokens.", float64(v.Stats.Rejected)},
+		{"waited_total", "counter", "Granted takes that had to wait for their tokens.", float64(v.Stats.Waited)},
+		{"wait_seconds_total", "counter", "Time granted takes had to wait.", v.Stats.WaitTime.Seconds()},
+		{"wasted_tokens_total", "counter", "Tokens not added because the bucket was full.", float64(v.Wasted)},
+	} {
+		name := "tokenbucket_" + m.name
+		fmt.Fprintf(&buf, "# HELP %s %s\n# TYPE %s %s\n%s %s\n", name, m.help, name, m.kind, name, strconv.FormatFloat(m.value, 'g', -1, 64))
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
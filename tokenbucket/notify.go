@@ -0,0 +1,69 @@
+package tokenbucket
+
+import (
+	"context"
+	"time"
+)
+
+// NotifyAvailable returns a channel that receives a single value
+// once at least count tokens are available in the bucket. No tokens
+// are taken, so by the time the value is received they may have
+// been taken by someone else. If ctx is done first, the channel is
+// closed instead, without receiving a value.
+//
+// The bucket is watched by a goroutine that sleeps on the limiter's
+// clock until the tokens are expected, and that exits once the value
+// has been sent or ctx is done. If count exceeds the capacity of the
+// bucket, the channel only ever receives when ctx is done. As with
+// WaitContext, a goroutine sleeping on the clock on behalf of a
+// cancelled watch lingers until its sleep would have ended.
+func (l *Limiter) NotifyAvailable(ctx context.Context, count int64) <-chan struct{} {
+	ch := make(chan struct{}, 1)
+	go func() {
+		for {
+			d := infinityDuration
+			if count <= l.Capacity() {
+				d = l.untilAvailable(l.now(), count)
+			}
+			if d <= 0 {
+				ch <- struct{}{}
+				return
+			}
+			var slept chan struct{}
+			if d < infinityDuration {
+				slept = make(chan struct{})
+				go func() {
+					l.clock.Sleep(d)
+					close(slept)
+				}()
+			}
+			select {
+			case <-slept:
+			case <-ctx.Done():
+				close(ch)
+				return
+			}
+		}
+	}()
+	return ch
+}
+
+// untilAvailable returns how long after now it will take for count
+// tokens to be available, assuming none are taken in the meantime.
+func (l *Limiter) untilAvailable(now time.Time, count int64) time.Duration {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	return l.accrualTime(now, count)
+}
+
+// accrualTime is like untilAvailable but must be called with l.mtx
+// held.
+func (l *Limiter) accrualTime(now time.Time, count int64) time.Duration {
+	l.adjustAvailableTokens(l.currentTick(now))
+	need := count - l.availableTokens
+	if need <= 0 {
+		return 0
+	}
+	endTick := l.latestTick + (need+l.quantum-1)/l.quantum
+	return l.tickTime(endTick).Sub(now)
+}
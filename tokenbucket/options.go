@@ -0,0 +1,368 @@
+package tokenbucket
+
+import (
+	"math"
+	"time"
+)
+
+// Option configures a Limiter.
+type Option interface {
+	apply(*Limiter)
+}
+
+type spinThresholdOption time.Duration
+
+func (o spinThresholdOption) apply(l *Limiter) {
+	l.spinThreshold = time.Duration(o)
+}
+
+// WithSpinThreshold returns an option that makes Wait and
+// WaitMaxDuration busy-wait, yielding the processor with
+// runtime.Gosched, instead of sleeping when the wait is shorter
+// than d.
+//
+// Sleeping for very short durations is imprecise, as the wait
+// is rounded up to the granularity of the runtime timers and the
+// scheduler. Spinning keeps microsecond-scale rates accurate, at
+// the cost of keeping a processor busy for the whole wait, so d
+// should be kept small. Spinning relies on the clock advancing
+// on its own, which a mock clock does not.
+func WithSpinThreshold(d time.Duration) Option {
+	return spinThresholdOption(d)
+}
+
+type onEmptyOption func()
+
+func (o onEmptyOption) apply(l *Limiter) {
+	l.onEmpty = o
+}
+
+// WithOnEmpty returns an option that makes the limiter call fn
+// whenever taking tokens empties the bucket, that is, when it
+// leaves zero or fewer tokens available where there were some
+// before. fn is called once per emptying; the bucket has to be
+// refilled before it can be emptied again. fn is called after the
+// limiter's lock has been released, by the goroutine that took the
+// tokens.
+func WithOnEmpty(fn func()) Option {
+	return onEmptyOption(fn)
+}
+
+type onRejectOption func(count int64, tag string)
+
+func (o onRejectOption) apply(l *Limiter) {
+	l.onReject = o
+}
+
+// WithOnReject returns an option that sets a function to be called
+// whenever a take is rejected, with the number of tokens requested
+// and the tag given to AllowTagged, which is empty for other takes.
+// It is called without the limiter's lock held, so it may call
+// methods on the limiter.
+func WithOnReject(fn func(count int64, tag string)) Option {
+	return onRejectOption(fn)
+}
+
+type penaltyOption struct {
+	penalty *Limiter
+}
+
+func (o penaltyOption) apply(l *Limiter) {
+	l.penalty = o.penalty
+}
+
+// WithPenalty returns an option that charges each rejected take
+// one token from the penalty bucket. Once the penalty bucket is
+// exhausted, TakeAvailable, TakeMaxDuration, WaitMaxDuration,
+// WaitContext, TakeTraced and ReserveInfo reject every request
+// regardless of the tokens available, until the penalty bucket
+// refills. Take and Wait cannot reject and so are not penalized.
+//
+// The penalty bucket's capacity sets how many rejections are
+// tolerated and its rate how quickly they are forgiven.
+func WithPenalty(penalty *Limiter) Option {
+	return penaltyOption{penalty: penalty}
+}
+
+// KeyedOption configures a KeyedLimiter.
+type KeyedOption interface {
+	apply(*KeyedLimiter)
+}
+
+type throttleTrackingOption struct {
+	window time.Duration
+	clock  Clock
+}
+
+func (o throttleTrackingOption) apply(k *KeyedLimiter) {
+	k.throttled = newThrottleTracker(o.window, o.clock)
+}
+
+// WithThrottleTracking returns an option that makes a KeyedLimiter
+// track the keys rejected most often by Allow, as reported by
+// TopThrottled. Rejections are counted over the last one to two
+// windows, in memory that does not grow with the number of keys.
+// If clock is nil, the system clock will be used.
+func WithThrottleTracking(window time.Duration, clock Clock) KeyedOption {
+	return throttleTrackingOption{window: window, clock: clock}
+}
+
+type allOrNothingBatchesOption struct{}
+
+func (allOrNothingBatchesOption) apply(k *KeyedLimiter) {
+	k.allOrNothing = true
+}
+
+// WithAllOrNothingBatches returns an option that makes AllowBatch
+// take tokens for either every key in a batch or none of them.
+func WithAllOrNothingBatches() KeyedOption {
+	return allOrNothingBatchesOption{}
+}
+
+type keyFilterOption struct {
+	filter *KeyFilter
+}
+
+func (o keyFilterOption) apply(k *KeyedLimiter) {
+	k.filter = o.filter
+}
+
+// WithKeyFilter returns an option that makes Allow and AllowBatch
+// consult filter first, and allow keys it definitely does not
+// contain without limiting them, or creating Limiters for them.
+// Keys that may be in the filter are limited as usual. This keeps
+// the long tail of untracked keys cheap when only a known set of
+// keys needs limiting. Keys may be added to filter at any time.
+func WithKeyFilter(filter *KeyFilter) KeyedOption {
+	return keyFilterOption{filter: filter}
+}
+
+type monotonicClockOption struct{}
+
+func (monotonicClockOption) apply(l *Limiter) {
+	l.monotonic = true
+}
+
+// WithMonotonicClock returns an option that makes the limiter
+// measure the passing of time with the monotonic reading of its
+// clock, which must implement MonotonicClock, so that stepping the
+// wall clock, as NTP may do, neither grants nor withholds tokens.
+// The system clock implements MonotonicClock.
+//
+// The system clock's times carry a monotonic reading that the
+// limiter already uses, so the option matters mainly for other
+// clocks.
+func WithMonotonicClock() Option {
+	return monotonicClockOption{}
+}
+
+type costTableOption map[string]int64
+
+func (o costTableOption) apply(l *Limiter) {
+	l.costs = o
+}
+
+// WithCostTable returns an option that gives the limiter a table of
+// the number of tokens each named operation costs, for use with
+// AllowOp and WaitOp. The table is copied.
+func WithCostTable(costs map[string]int64) Option {
+	o := make(costTableOption, len(costs))
+	for op, cost := range costs {
+		o[op] = cost
+	}
+	return o
+}
+
+type timerResolutionOption time.Duration
+
+func (o timerResolutionOption) apply(l *Limiter) {
+	l.timerResolution = time.Duration(o)
+}
+
+// WithTimerResolution returns an option that rounds the sleeps of
+// Wait, WaitMaxDuration and WaitContext up to a multiple of d, the
+// resolution of the platform's timers - around 15ms by default on
+// Windows, for instance. Asking a coarse timer for a shorter sleep
+// wakes the caller early or at an arbitrary tick; rounding up
+// instead means each wait ends on a timer tick no earlier than
+// the tokens are due. Only sleeping is affected: tokens are
+// accounted for exactly as without the option.
+func WithTimerResolution(d time.Duration) Option {
+	return timerResolutionOption(d)
+}
+
+type takeHistoryOption int
+
+func (o takeHistoryOption) apply(l *Limiter) {
+	l.history = newTakeHistory(int(o))
+}
+
+// WithTakeHistory returns an option that makes the limiter remember
+// its most recent size successful takes, for TakeHistogram.
+func WithTakeHistory(size int) Option {
+	return takeHistoryOption(size)
+}
+
+type pressureRangeOption struct {
+	min, max float64
+}
+
+func (o pressureRangeOption) apply(l *Limiter) {
+	l.minPressureRate, l.maxPressureRate = o.min, o.max
+}
+
+// WithPressureRange returns an option that sets the range of rates,
+// in tokens per second, that SetPressure scales between. Both rates
+// must be positive, and min no greater than max.
+func WithPressureRange(min, max float64) Option {
+	if min <= 0 || max < min {
+		panic("token bucket pressure range is invalid")
+	}
+	return pressureRangeOption{min: min, max: max}
+}
+
+type creditCapOption float64
+
+func (o creditCapOption) apply(l *Limiter) {
+	l.creditMultiplier = float64(o)
+}
+
+// WithCreditCap returns an option that lets tokens left unused
+// bank up beyond the bucket's capacity, to at most multiplier times
+// the capacity, so that a long idle period earns a larger burst.
+// The bucket still starts with only its capacity. Tokens are
+// interchangeable, so a take spends banked credits before the
+// regular allowance. Credits are banked only until the bucket is
+// first spent below its capacity; from then on it refills to its
+// capacity and no further. The multiplier must be at least one.
+func WithCreditCap(multiplier float64) Option {
+	if multiplier < 1 {
+		panic("token bucket credit multiplier is not >= 1")
+	}
+	return creditCapOption(multiplier)
+}
+
+type recorderOption struct{}
+
+func (recorderOption) apply(l *Limiter) {
+	l.recorder = &takeRecorder{}
+}
+
+// WithRecorder returns an option that makes the limiter record its
+// most recent takes, including rejected ones, for ExportHistory.
+func WithRecorder() Option {
+	return recorderOption{}
+}
+
+type admissionFilterOption func(count int64) bool
+
+func (o admissionFilterOption) apply(l *Limiter) {
+	l.admit = o
+}
+
+// WithAdmissionFilter returns an option that makes the limiter call
+// filter before each take that can fail, with the number of tokens
+// requested. If filter returns false the take is rejected at once,
+// however many tokens are available: TakeMaxDuration, TakeAvailable
+// and the like take nothing, WaitContext and WaitOp return
+// ErrVetoed, and TakeTraced and ReserveInfo take nothing and return a
+// zero wait. Take and Wait cannot fail, so they are not filtered.
+// The filter is called without the limiter's lock held, so it may
+// consult external state such as a kill switch.
+func WithAdmissionFilter(filter func(count int64) bool) Option {
+	return admissionFilterOption(filter)
+}
+
+type lifetimeQuotaOption int64
+
+func (o lifetimeQuotaOption) apply(l *Limiter) {
+	l.lifetimeQuota = int64(o)
+}
+
+// WithLifetimeQuota returns an option that limits the total number
+// of tokens the limiter ever grants to total, however many its rate
+// would allow, to model a prepaid quota. Once a take would go beyond
+// it, the take is rejected: TakeMaxDuration and the like take
+// nothing, TakeAvailable takes only what is left of the quota, and
+// WaitContext and WaitOp return ErrQuotaExhausted. Take and Wait
+// cannot report the rejection, so they return straight away without
+// granting any tokens; use WaitContext, which returns
+// ErrQuotaExhausted, or the other methods with a lifetime quota.
+func WithLifetimeQuota(total int64) Option {
+	if total <= 0 {
+		panic("token bucket lifetime quota is not > 0")
+	}
+	return lifetimeQuotaOption(total)
+}
+
+type grantedSizeHistogramOption struct{}
+
+func (grantedSizeHistogramOption) apply(l *Limiter) {
+	l.sizes = make(sizeHistogram)
+}
+
+// WithGrantedSizeHistogram returns an option that makes the limiter
+// count its takes by the number of tokens requested, for
+// GrantedSizeHistogram.
+func WithGrantedSizeHistogram() Option {
+	return grantedSizeHistogramOption{}
+}
+
+type clockGuardOption ClockGuard
+
+func (o clockGuardOption) apply(l *Limiter) {
+	l.clockGuard = ClockGuard(o)
+}
+
+// WithClockGuard returns an option that sets what the limiter does
+// when its clock returns an implausible time. A clock that does so
+// when the limiter is created always causes a panic, as there is no
+// earlier time to fall back on.
+func WithClockGuard(guard ClockGuard) Option {
+	return clockGuardOption(guard)
+}
+
+type minGrantRateOption float64
+
+func (o minGrantRateOption) apply(l *Limiter) {
+	l.minGrantRate = float64(o)
+}
+
+// WithMinGrantRate returns an option that guarantees the limiter
+// grants at least rate tokens per second, which must be positive, so
+// that no client is starved entirely. The limiter's rate is never
+// set below rate, whether by SetRate, SetPressure, RampRate, Swap or
+// the like, and takes refused because of a penalty are let through
+// anyway, as long as the bucket grants them and they stay within
+// rate.
+func WithMinGrantRate(rate float64) Option {
+	if rate <= 0 {
+		panic("token bucket minimum grant rate is not > 0")
+	}
+	return minGrantRateOption(rate)
+}
+
+type maxBurstRateOption time.Duration
+
+func (o maxBurstRateOption) apply(l *Limiter) {
+	l.burstInterval = time.Duration(o)
+}
+
+// WithMaxBurstRate returns an option that smooths the tokens
+// granted, so that however many tokens the bucket holds they are
+// not granted faster than perSec tokens per second, which must be
+// positive and at most one per nanosecond. Tokens are released one
+// at a time at that rate, as if the bucket drained through a leaky
+// bucket, and a take is granted with its last token: Take and the
+// like wait accordingly, TakeAvailable takes at most one token, and
+// takes that do not wait are rejected until a token is due.
+func WithMaxBurstRate(perSec float64) Option {
+	if perSec <= 0 || perSec > 1e9 {
+		panic("token bucket maximum burst rate is not in (0, 1e9]")
+	}
+	interval := float64(time.Second) / perSec
+	if interval >= math.MaxInt64 {
+		panic("token bucket maximum burst rate is too small")
+	}
+	return maxBurstRateOption(interval)
+}
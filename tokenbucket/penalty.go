@@ -0,0 +1,44 @@
+package tokenbucket
+
+import "errors"
+
+// ErrPenalized is returned by WaitContext and WaitOp when a take is
+// rejected because the limiter's penalty bucket is exhausted.
+var ErrPenalized = errors.New("tokenbucket: take rejected by penalty")
+
+// penalized reports whether earlier rejections have exhausted the
+// penalty bucket, in which case a take of count tokens is rejected
+// outright unless the minimum grant rate lets it through. Such
+// rejections are counted in the limiter's stats. If the take is let
+// through only by the minimum grant rate, floored is true, and the
+// caller must pass the tokens the bucket grants it to chargeFloor.
+func (l *Limiter) penalized(count int64) (rejected, floored bool) {
+	if l.penalty == nil || l.penalty.Available() > 0 {
+		return false, false
+	}
+	if l.floor != nil && l.floor.Available() >= count {
+		return false, true
+	}
+	l.mtx.Lock()
+	l.stats.Rejected++
+	l.mtx.Unlock()
+	return true, false
+}
+
+// chargeFloor takes count tokens, granted to a take that the minimum
+// grant rate let through a penalty, from the floor bucket, so that
+// such takes stay within that rate. l.mtx must be held.
+func (l *Limiter) chargeFloor(count int64) {
+	if count > 0 {
+		l.floor.Take(count)
+	}
+}
+
+// grantRate returns rate, raised if necessary to the minimum grant
+// rate given by WithMinGrantRate.
+func (l *Limiter) grantRate(rate float64) float64 {
+	if rate < l.minGrantRate {
+		return l.minGrantRate
+	}
+	return rate
+}
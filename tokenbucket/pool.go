@@ -0,0 +1,77 @@
+package tokenbucket
+
+import (
+	"context"
+	"sync"
+)
+
+// RateLimitedPool runs submitted tasks on a fixed number of worker
+// goroutines, taking a token from a Limiter before starting each,
+// so that both the number of tasks running at once and the rate at
+// which they start are bounded.
+// Methods on RateLimitedPool may be called concurrently.
+type RateLimitedPool struct {
+	l     *Limiter
+	tasks chan poolTask
+	wg    sync.WaitGroup
+}
+
+// poolTask holds a submitted task, the context it was submitted
+// with and the channel on which its worker reports whether it was
+// started.
+type poolTask struct {
+	ctx     context.Context
+	fn      func()
+	started chan error
+}
+
+// NewRateLimitedPool returns a pool that runs tasks on the given
+// number of workers, starting each once a token is available from l.
+func NewRateLimitedPool(l *Limiter, workers int) *RateLimitedPool {
+	if workers <= 0 {
+		panic("rate limited pool worker count is not > 0")
+	}
+	p := &RateLimitedPool{
+		l:     l,
+		tasks: make(chan poolTask),
+	}
+	p.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+	return p
+}
+
+// work runs tasks until the pool is closed.
+func (p *RateLimitedPool) work() {
+	defer p.wg.Done()
+	for t := range p.tasks {
+		err := p.l.WaitContext(t.ctx, 1)
+		t.started <- err
+		if err == nil {
+			t.fn()
+		}
+	}
+}
+
+// Submit waits for a worker to be free and a token to be available,
+// then starts fn on the worker and returns without waiting for it to
+// finish. If ctx is done first, fn is not run and Submit returns the
+// error from WaitContext, usually ctx's error. Submit must not be
+// called once Close has been.
+func (p *RateLimitedPool) Submit(ctx context.Context, fn func()) error {
+	t := poolTask{ctx: ctx, fn: fn, started: make(chan error, 1)}
+	select {
+	case p.tasks <- t:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return <-t.started
+}
+
+// Close stops the workers once their current tasks have finished,
+// and waits for them to do so.
+func (p *RateLimitedPool) Close() {
+	close(p.tasks)
+	p.wg.Wait()
+}
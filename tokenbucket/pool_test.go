@@ -0,0 +1,116 @@
+package tokenbucket
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRateLimitedPool(t *testing.T) {
+	const (
+		workers  = 3
+		tasks    = 20
+		interval = 10 * time.Millisecond
+	)
+	c := newSleeperClock()
+	l := NewLimiterWithClock(interval, 1, c)
+	p := NewRateLimitedPool(l, workers)
+
+	// Tasks start one fill interval apart, as tokens become
+	// available.
+	var (
+		mtx    sync.Mutex
+		starts []time.Time
+	)
+	started := func() int {
+		mtx.Lock()
+		defer mtx.Unlock()
+		return len(starts)
+	}
+	go func() {
+		for i := 0; i < tasks; i++ {
+			err := p.Submit(context.Background(), func() {
+				mtx.Lock()
+				starts = append(starts, c.Now())
+				mtx.Unlock()
+			})
+			if err != nil {
+				t.Errorf("submit %d: %v", i, err)
+				return
+			}
+		}
+	}()
+	for i := 0; i < tasks; i++ {
+		if i > 0 {
+			c.waitSleepers(t, 1)
+			c.add(interval)
+		}
+		for deadline := time.Now().Add(5 * time.Second); started() <= i; {
+			if time.Now().After(deadline) {
+				t.Fatalf("task %d did not start", i)
+			}
+			time.Sleep(100 * time.Microsecond)
+		}
+	}
+	p.Close()
+	for i := 1; i < len(starts); i++ {
+		if gap := starts[i].Sub(starts[i-1]); gap != interval {
+			t.Fatalf("tasks %d and %d started %v apart, want %v", i-1, i, gap, interval)
+		}
+	}
+
+	// With tokens to spare, the number of workers bounds the tasks
+	// running at once.
+	l = NewLimiterWithClock(interval, 100, c)
+	p = NewRateLimitedPool(l, workers)
+	var running, maxRun int32
+	release := make(chan struct{})
+	task := func() {
+		n := atomic.AddInt32(&running, 1)
+		for {
+			max := atomic.LoadInt32(&maxRun)
+			if n <= max || atomic.CompareAndSwapInt32(&maxRun, max, n) {
+				break
+			}
+		}
+		<-release
+		atomic.AddInt32(&running, -1)
+	}
+	for i := 0; i < workers; i++ {
+		if err := p.Submit(context.Background(), task); err != nil {
+			t.Fatalf("submit %d: %v", i, err)
+		}
+	}
+	submitted := make(chan error)
+	go func() {
+		submitted <- p.Submit(context.Background(), task)
+	}()
+	select {
+	case err := <-submitted:
+		t.Fatalf("submit beyond the workers returned %v while all were busy", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+	release <- struct{}{}
+	if err := <-submitted; err != nil {
+		t.Fatalf("submit once a worker was free: %v", err)
+	}
+	close(release)
+	p.Close()
+	if maxRun != workers {
+		t.Fatalf("%d tasks ran at once, want %d", maxRun, workers)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	p = NewRateLimitedPool(l, 1)
+	defer p.Close()
+	ran := false
+	if err := p.Submit(ctx, func() { ran = true }); err != context.Canceled {
+		t.Fatalf("submit with cancelled context returned %v, want context.Canceled", err)
+	}
+	if ran {
+		t.Fatalf("task ran after its context was cancelled")
+	}
+}
@@ -0,0 +1,49 @@
+package tokenbucket
+
+import (
+	"sync"
+	"time"
+)
+
+// fillQuantum holds a fill interval and quantum worked out for a rate.
+type fillQuantum struct {
+	fillInterval time.Duration
+	quantum      int64
+}
+
+var (
+	// rateCacheMtx guards rateCache.
+	rateCacheMtx sync.RWMutex
+	rateCache    map[float64]fillQuantum
+)
+
+// PrecomputeRates works out the fill interval and quantum for each
+// of the given rates up front and caches them, so that later calls
+// to NewLimiterWithRate, SetRate and the like for those rates do not
+// need to search for them. It is intended for programs that create
+// many limiters at a handful of known rates.
+func PrecomputeRates(rates ...float64) {
+	computed := make(map[float64]fillQuantum, len(rates))
+	for _, rate := range rates {
+		fillInterval, quantum := computeRateQuantum(rate)
+		computed[rate] = fillQuantum{fillInterval, quantum}
+	}
+
+	rateCacheMtx.Lock()
+	defer rateCacheMtx.Unlock()
+	if rateCache == nil {
+		rateCache = make(map[float64]fillQuantum, len(computed))
+	}
+	for rate, fq := range computed {
+		rateCache[rate] = fq
+	}
+}
+
+// cachedRateQuantum returns the values cached for rate by
+// PrecomputeRates, if any.
+func cachedRateQuantum(rate float64) (fillQuantum, bool) {
+	rateCacheMtx.RLock()
+	defer rateCacheMtx.RUnlock()
+	fq, ok := rateCache[rate]
+	return fq, ok
+}
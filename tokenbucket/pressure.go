@@ -0,0 +1,18 @@
+package tokenbucket
+
+// SetPressure sets the rate of the bucket from an external pressure
+// signal p in [0, 1], scaling it linearly from the minimum rate of
+// the range given by WithPressureRange, at 0, to the maximum, at 1.
+// Values of p outside [0, 1] are clamped. It panics if the limiter
+// was created without WithPressureRange.
+func (l *Limiter) SetPressure(p float64) {
+	if l.maxPressureRate == 0 {
+		panic("token bucket has no pressure range")
+	}
+	if p < 0 {
+		p = 0
+	} else if p > 1 {
+		p = 1
+	}
+	l.SetRate(l.minPressureRate + p*(l.maxPressureRate-l.minPressureRate))
+}
@@ -0,0 +1,64 @@
+package tokenbucket
+
+import (
+	"context"
+	"errors"
+)
+
+// probeRounds holds the number of times ProbeRate calls probe
+// at each rate.
+const probeRounds = 10
+
+// ErrProbeFailed is returned by ProbeRate when the probe fails at
+// the starting rate.
+var ErrProbeFailed = errors.New("tokenbucket: probe failed at the starting rate")
+
+// ProbeRate discovers the highest rate a downstream can sustain.
+// Starting at start tokens per second, it sets the rate of l, waits
+// for a token and calls probe, a number of times at each rate,
+// raising the rate by step while every call succeeds. Once probe
+// reports failure, it backs the rate off to the last rate at which
+// every call succeeded and returns it.
+//
+// ProbeRate keeps ramping for as long as probe succeeds, so ctx
+// should bound it. If ctx is done first, the rate is backed off in
+// the same way and returned along with ctx's error. If the probe
+// fails at the starting rate, ErrProbeFailed is returned.
+//
+// The calls to probe are paced by the bucket, so its capacity
+// should be small for them to reflect the rate being probed.
+func (l *Limiter) ProbeRate(ctx context.Context, start, step float64, probe func() bool) (float64, error) {
+	if start <= 0 {
+		panic("token bucket probe start rate is not > 0")
+	}
+	if step <= 0 {
+		panic("token bucket probe step is not > 0")
+	}
+
+	best := 0.0
+	for rate := start; ; rate += step {
+		l.SetRate(rate)
+		for i := 0; i < probeRounds; i++ {
+			if err := ctx.Err(); err != nil {
+				return l.backOff(best), err
+			}
+			l.Wait(1)
+			if !probe() {
+				if best == 0 {
+					return 0, ErrProbeFailed
+				}
+				return l.backOff(best), nil
+			}
+		}
+		best = rate
+	}
+}
+
+// backOff sets the rate of l to rate if it is positive, and
+// returns it.
+func (l *Limiter) backOff(rate float64) float64 {
+	if rate > 0 {
+		l.SetRate(rate)
+	}
+	return rate
+}
@@ -0,0 +1,110 @@
+package tokenbucket
+
+import (
+	"sync"
+	"time"
+)
+
+// QuotaTracker calibrates a Limiter to the quota reported by a
+// server, typically in X-RateLimit-Remaining and X-RateLimit-Reset
+// response headers, so that a client paces itself to the quota it
+// actually has left rather than finding out by being rejected.
+// Methods on QuotaTracker may be called concurrently.
+type QuotaTracker struct {
+	l *Limiter
+
+	// baseRate holds the rate the limiter is restored to
+	// when the reported quota resets.
+	baseRate float64
+
+	// mtx guards the fields below it.
+	mtx sync.Mutex
+
+	// reset holds the time the latest reported quota
+	// resets at.
+	reset time.Time
+
+	// restoring records whether a goroutine is waiting to
+	// restore the base rate at reset.
+	restoring bool
+}
+
+// NewQuotaTracker returns a tracker that calibrates l. The rate l
+// has when the tracker is created is taken as its normal rate, to
+// which it returns whenever the reported quota resets.
+func NewQuotaTracker(l *Limiter) *QuotaTracker {
+	return &QuotaTracker{
+		l:        l,
+		baseRate: l.Rate(),
+	}
+}
+
+// Observe records that the server reported remaining requests left
+// in the quota until reset. Tokens the limiter holds beyond
+// remaining are dropped, and until reset the limiter's rate is
+// lowered, if necessary, so that the remaining quota is spread
+// evenly over the time left. When no quota remains, the next token
+// becomes available at reset. A reset time that has already passed
+// restores the normal rate.
+func (q *QuotaTracker) Observe(remaining int64, reset time.Time) {
+	if remaining < 0 {
+		remaining = 0
+	}
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	now := q.l.now()
+	left := reset.Sub(now)
+	if left <= 0 {
+		q.reset = time.Time{}
+		q.l.SetRate(q.baseRate)
+		return
+	}
+
+	q.l.limitAvailable(now, remaining)
+	rate := float64(remaining) / left.Seconds()
+	if remaining == 0 {
+		rate = 1 / left.Seconds()
+	}
+	if rate > q.baseRate {
+		rate = q.baseRate
+	}
+	q.l.SetRate(rate)
+	q.reset = reset
+	if !q.restoring {
+		q.restoring = true
+		go q.restore(left)
+	}
+}
+
+// restore waits until the latest reported quota resets, starting
+// with a wait of d, and then restores the normal rate.
+func (q *QuotaTracker) restore(d time.Duration) {
+	for {
+		q.l.clock.Sleep(d)
+		q.mtx.Lock()
+		if q.reset.IsZero() {
+			q.restoring = false
+			q.mtx.Unlock()
+			return
+		}
+		if d = q.reset.Sub(q.l.now()); d <= 0 {
+			q.reset = time.Time{}
+			q.restoring = false
+			q.l.SetRate(q.baseRate)
+			q.mtx.Unlock()
+			return
+		}
+		q.mtx.Unlock()
+	}
+}
+
+// limitAvailable drops any tokens available beyond max as of the
+// given time.
+func (l *Limiter) limitAvailable(now time.Time, max int64) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	l.adjustAvailableTokens(l.currentTick(now))
+	if l.availableTokens > max {
+		l.availableTokens = max
+	}
+}
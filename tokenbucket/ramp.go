@@ -0,0 +1,121 @@
+package tokenbucket
+
+import "time"
+
+// rampSteps holds the number of steps in which RampRate changes the
+// rate.
+const rampSteps = 100
+
+// RampRate changes the rate at which the bucket fills to target
+// tokens per second, which must be positive, moving it linearly
+// from the current rate over the given period rather than all at
+// once, so that downstream systems see throughput change gradually.
+// The rate is changed in small steps, as with SetRate, by a goroutine
+// sleeping on the limiter's clock.
+//
+// A later call to RampRate starts a new ramp from the rate reached
+// so far, and a call to SetRate ends the ramp. If over is not
+// positive, RampRate is equivalent to SetRate.
+func (l *Limiter) RampRate(target float64, over time.Duration) {
+	if target <= 0 {
+		panic("token bucket rate is not > 0")
+	}
+	if over <= 0 {
+		l.SetRate(target)
+		return
+	}
+	l.mtx.Lock()
+	from := l.requestedRate
+	if from == 0 {
+		from = fillRate(l.fillInterval, l.quantum)
+	}
+	l.rampGen++
+	gen := l.rampGen
+	l.mtx.Unlock()
+
+	go func() {
+		for i := 1; i <= rampSteps; i++ {
+			l.clock.Sleep(over / rampSteps)
+			rate := from + (target-from)*float64(i)/rampSteps
+			if i == rampSteps {
+				rate = target
+			}
+			if !l.rampStep(gen, rate) {
+				return
+			}
+		}
+	}()
+}
+
+// rampStep sets the rate for a step of the ramp started as the
+// given generation, and reports whether that ramp is still current.
+func (l *Limiter) rampStep(gen uint64, rate float64) bool {
+	rate = l.grantRate(rate)
+	fillInterval, quantum := rateQuantum(rate)
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if l.rampGen != gen {
+		return false
+	}
+	l.setFill(l.now(), fillInterval, quantum)
+	l.requestedRate = rate
+	return true
+}
+
+// RampTo warms the bucket up to targetAvailable tokens over the given
+// period rather than all at once, smoothing the burst allowed at
+// startup. A goroutine sleeping on the limiter's clock tops the
+// bucket up, in small steps, to a level moving linearly from the
+// tokens available now to targetAvailable; tokens that accrue as
+// usual meanwhile count towards it. Tokens taken during the ramp are
+// made up at the next step. The target is limited to the most the
+// bucket can hold.
+//
+// A later call to RampTo ends the ramp. If over is not positive, the
+// bucket is topped up to targetAvailable straight away.
+func (l *Limiter) RampTo(targetAvailable int64, over time.Duration) {
+	if targetAvailable < 0 {
+		panic("token bucket target is not >= 0")
+	}
+	now := l.now()
+	l.mtx.Lock()
+	l.adjustAvailableTokens(l.currentTick(now))
+	from := l.availableTokens
+	l.warmGen++
+	gen := l.warmGen
+	l.mtx.Unlock()
+	if over <= 0 {
+		l.warmStep(gen, targetAvailable)
+		return
+	}
+
+	go func() {
+		for i := int64(1); i <= rampSteps; i++ {
+			l.clock.Sleep(over / rampSteps)
+			level := from + (targetAvailable-from)*i/rampSteps
+			if !l.warmStep(gen, level) {
+				return
+			}
+		}
+	}()
+}
+
+// warmStep tops the bucket up to the given level for a step of the
+// ramp started by RampTo as the given generation, and reports
+// whether that ramp is still current.
+func (l *Limiter) warmStep(gen uint64, level int64) bool {
+	now := l.now()
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if l.warmGen != gen {
+		return false
+	}
+	l.adjustAvailableTokens(l.currentTick(now))
+	if max := l.accrualCap(); level > max {
+		level = max
+	}
+	if l.availableTokens < level {
+		l.availableTokens = level
+	}
+	return true
+}
@@ -2,8 +2,10 @@ package tokenbucket
 
 import (
 	"math"
+	"runtime"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -35,15 +37,89 @@ import (
 // Limiter represents a token bucket that fills at a predetermined rate.
 // Methods on Limiter may be called concurrently.
 type Limiter struct {
+	// lastGoodTime holds, in Unix nanoseconds, the most recent
+	// plausible time returned by the clock, if the clock guard
+	// clamps implausible times. It is accessed atomically and
+	// is first in the struct to keep it 64-bit aligned.
+	lastGoodTime int64
+
+	// blocked is set to 1, atomically, once a take has
+	// had to wait.
+	blocked int32
+
 	clock Clock
 
-	// startTime holds the moment when the bucket was
-	// first created and ticks began.
-	startTime time.Time
+	// clockGuard determines what happens when the clock
+	// returns an implausible time.
+	clockGuard ClockGuard
+
+	// spinThreshold holds the duration below which
+	// waits spin rather than sleep.
+	spinThreshold time.Duration
+
+	// timerResolution holds the granularity that
+	// sleeps are rounded up to.
+	timerResolution time.Duration
+
+	// onEmpty holds the function called when a take
+	// empties the bucket.
+	onEmpty func()
+
+	// onReject holds the function called when a take
+	// is rejected.
+	onReject func(count int64, tag string)
+
+	// penalty holds the bucket that rejected takes
+	// are charged to.
+	penalty *Limiter
+
+	// costs holds the number of tokens each named
+	// operation costs.
+	costs map[string]int64
+
+	// minPressureRate and maxPressureRate hold the range
+	// of rates SetPressure scales between, if set.
+	minPressureRate, maxPressureRate float64
+
+	// admit, if set, is consulted before each fallible take
+	// and may veto it.
+	admit func(count int64) bool
+
+	// lifetimeQuota, if positive, holds the total number of
+	// tokens the limiter will ever grant.
+	lifetimeQuota int64
+
+	// creditMultiplier, if greater than one, lets idle time
+	// bank tokens beyond the capacity, up to this multiple of it.
+	creditMultiplier float64
+	// creditSpent records that the bucket has been spent below
+	// its capacity, after which it no longer banks credits.
+	creditSpent bool
+
+	// minGrantRate, if positive, holds the rate below which
+	// the rate is never set, and floor the bucket that lets
+	// takes through at that rate despite a penalty.
+	minGrantRate float64
+	floor        *Limiter
+
+	// monotonic records whether the time is measured
+	// with the clock's monotonic reading. If so,
+	// monoStart holds the reading at monoBase.
+	monotonic bool
+	monoBase  time.Time
+	monoStart time.Duration
+
+	// mtx guards the fields below it.
+	mtx sync.Mutex
 
 	// capacity holds the overall capacity of the bucket.
 	capacity int64
 
+	// startTime holds the moment when ticks began,
+	// which is when the bucket was first created unless
+	// its rate has been changed since.
+	startTime time.Time
+
 	// fillInterval holds the interval between each tick.
 	fillInterval time.Duration
 
@@ -51,8 +127,10 @@ type Limiter struct {
 	// each tick.
 	quantum int64
 
-	// mtx guards the fields below it.
-	mtx sync.Mutex
+	// requestedRate holds the rate, in tokens per second,
+	// that fillInterval and quantum approximate, or zero if
+	// they were given directly.
+	requestedRate float64
 
 	// availableTokens holds the number of available
 	// tokens as of the associated latestTick.
@@ -63,48 +141,151 @@ type Limiter struct {
 	// latestTick holds the latest tick for which
 	// we know the number of tokens in the bucket.
 	latestTick int64
+
+	// emptied records whether the bucket has been emptied
+	// while mtx has been held.
+	emptied bool
+
+	// rejected records whether a take has been rejected
+	// while mtx has been held, and rejectedCount and
+	// rejectedTag the number of tokens it requested and
+	// its tag.
+	rejected      bool
+	rejectedCount int64
+	rejectedTag   string
+
+	// tag holds the tag of the take in progress, if any.
+	tag string
+
+	// paused records whether the limiter is paused.
+	paused bool
+
+	// pause holds the channel closed when the
+	// limiter is paused.
+	pause chan struct{}
+
+	// rampGen is incremented whenever the rate is set, ending
+	// any ramp started by RampRate.
+	rampGen uint64
+
+	// warmGen is incremented by RampTo, ending any
+	// earlier ramp it started.
+	warmGen uint64
+
+	// lastTake and prevTake hold the times at which the
+	// two most recent takes were granted.
+	lastTake, prevTake time.Time
+
+	// history holds the most recent takes, if enabled.
+	history *takeHistory
+
+	// recorder holds the most recent takes, if enabled.
+	recorder *takeRecorder
+
+	// sizes counts takes by size, if enabled.
+	sizes sizeHistogram
+
+	// stats holds the activity counters returned by Stats.
+	stats Stats
+
+	// wasted holds the number of tokens that would have
+	// accrued but for the bucket being full.
+	wasted int64
+
+	// burstInterval, if positive, holds the minimum interval
+	// between tokens granted, and nextGrant the earliest time
+	// the first token of the next take may be released.
+	burstInterval time.Duration
+	nextGrant     time.Time
+
+	// emptySpans holds the most recent periods during
+	// which the bucket was empty, oldest first.
+	emptySpans []timeSpan
 }
 
 // NewLimiter returns a new token bucket that fills at the
 // rate of one token every fillInterval, up to the given
 // maximum capacity. Both arguments must be
 // positive. The bucket is initially full.
-func NewLimiter(fillInterval time.Duration, capacity int64) *Limiter {
-	return NewLimiterWithClock(fillInterval, capacity, nil)
+func NewLimiter(fillInterval time.Duration, capacity int64, opts ...Option) *Limiter {
+	return NewLimiterWithClock(fillInterval, capacity, nil, opts...)
 }
 
 // NewLimiterWithClock is identical to NewLimiter but injects a testable clock
 // interface.
-func NewLimiterWithClock(fillInterval time.Duration, capacity int64, clock Clock) *Limiter {
-	return NewLimiterWithQuantumAndClock(fillInterval, 1, capacity, clock)
+func NewLimiterWithClock(fillInterval time.Duration, capacity int64, clock Clock, opts ...Option) *Limiter {
+	return NewLimiterWithQuantumAndClock(fillInterval, 1, capacity, clock, opts...)
 }
 
-// rateMargin specifies the allowed variance of actual
+// RateMargin specifies the allowed variance of actual
 // rate from specified rate. 1% seems reasonable.
-const rateMargin = 0.01
+const RateMargin = 0.01
+
+// ApproxEqualRate reports whether the rates a and b, in tokens per
+// second, differ by no more than RateMargin of the larger of them.
+// It holds for the rate of a limiter created by NewLimiterWithRate
+// and the rate it was created with.
+func ApproxEqualRate(a, b float64) bool {
+	return math.Abs(a-b) <= RateMargin*math.Max(math.Abs(a), math.Abs(b))
+}
 
 // NewLimiterWithRate returns a token bucket that fills the bucket
 // at the rate of rate tokens per second up to the given
 // maximum capacity. Because of limited clock resolution,
-// at high rates, the actual rate may be up to 1% different from the
-// specified rate.
-func NewLimiterWithRate(rate float64, capacity int64) *Limiter {
-	return NewLimiterWithRateAndClock(rate, capacity, nil)
+// at high rates, the actual rate may be up to 1% (RateMargin)
+// different from the specified rate. Up to a million tokens per
+// second it is within 0.1%. Rates below about 1.1e-10 tokens per
+// second, whose fill interval does not fit in a time.Duration, and
+// above about 5e23 cannot be represented and cause a panic.
+func NewLimiterWithRate(rate float64, capacity int64, opts ...Option) *Limiter {
+	return NewLimiterWithRateAndClock(rate, capacity, nil, opts...)
 }
 
+// maxRate is the highest rate, in tokens per second, that
+// NewLimiterWithRate is known to represent.
+const maxRate = 5e23
+
 // NewLimiterWithRateAndClock is identical to NewLimiterWithRate but injects a
 // testable clock interface.
-func NewLimiterWithRateAndClock(rate float64, capacity int64, clock Clock) *Limiter {
-	l := NewLimiterWithQuantumAndClock(1, 1, capacity, clock)
+func NewLimiterWithRateAndClock(rate float64, capacity int64, clock Clock, opts ...Option) *Limiter {
+	fillInterval, quantum := rateQuantum(rate)
+	l := NewLimiterWithQuantumAndClock(fillInterval, quantum, capacity, clock, opts...)
+	if l.requestedRate == 0 {
+		l.requestedRate = rate
+	}
+	return l
+}
+
+// QuantizeRate returns the fill interval and quantum that
+// NewLimiterWithRate would use for rate, along with the actual rate,
+// in tokens per second, they represent. The actual rate is exactly
+// what Rate reports for a limiter created with them, and may be up
+// to 1% different from rate.
+func QuantizeRate(rate float64) (actual float64, fillInterval time.Duration, quantum int64) {
+	fillInterval, quantum = rateQuantum(rate)
+	return fillRate(fillInterval, quantum), fillInterval, quantum
+}
+
+// rateQuantum returns the fill interval and quantum that best
+// represent the given rate, using the values cached by
+// PrecomputeRates if there are any.
+func rateQuantum(rate float64) (time.Duration, int64) {
+	if fq, ok := cachedRateQuantum(rate); ok {
+		return fq.fillInterval, fq.quantum
+	}
+	return computeRateQuantum(rate)
+}
+
+// computeRateQuantum searches for the fill interval and quantum
+// that best represent the given rate.
+func computeRateQuantum(rate float64) (time.Duration, int64) {
 	for quantum := int64(1); quantum < 1<<50; quantum = nextQuantum(quantum) {
 		fillInterval := time.Duration(1e9 * float64(quantum) / rate)
 		if fillInterval <= 0 {
 			continue
 		}
-		l.fillInterval = fillInterval
-		l.quantum = quantum
-		if diff := math.Abs(l.Rate() - rate); diff/rate <= rateMargin {
-			return l
+		if diff := math.Abs(fillRate(fillInterval, quantum) - rate); diff/rate <= RateMargin {
+			return fillInterval, quantum
 		}
 	}
 	panic("cannot find suitable quantum for " + strconv.FormatFloat(rate, 'g', -1, 64))
@@ -121,14 +302,14 @@ func nextQuantum(q int64) int64 {
 // NewLimiterWithQuantumAndClock is similar to NewLimiter, but allows
 // the specification of the quantum size - quantum tokens
 // are added every fillInterval.
-func NewLimiterWithQuantum(fillInterval time.Duration, quantum, capacity int64) *Limiter {
-	return NewLimiterWithQuantumAndClock(fillInterval, quantum, capacity, nil)
+func NewLimiterWithQuantum(fillInterval time.Duration, quantum, capacity int64, opts ...Option) *Limiter {
+	return NewLimiterWithQuantumAndClock(fillInterval, quantum, capacity, nil, opts...)
 }
 
 // NewLimiterWithQuantumAndClock is like NewLimiterWithQuantum, but
 // also has a clock argument that allows clients to fake the passing
 // of time. If clock is nil, the system clock will be used.
-func NewLimiterWithQuantumAndClock(fillInterval time.Duration, quantum, capacity int64, clock Clock) *Limiter {
+func NewLimiterWithQuantumAndClock(fillInterval time.Duration, quantum, capacity int64, clock Clock, opts ...Option) *Limiter {
 	if clock == nil {
 		clock = realClock{}
 	}
@@ -141,7 +322,7 @@ func NewLimiterWithQuantumAndClock(fillInterval time.Duration, quantum, capacity
 	if quantum <= 0 {
 		panic("token bucket quantum is not > 0")
 	}
-	return &Limiter{
+	l := &Limiter{
 		clock:           clock,
 		startTime:       clock.Now(),
 		latestTick:      0,
@@ -150,24 +331,202 @@ func NewLimiterWithQuantumAndClock(fillInterval time.Duration, quantum, capacity
 		quantum:         quantum,
 		availableTokens: capacity,
 	}
+	for _, opt := range opts {
+		opt.apply(l)
+	}
+	if !plausibleTime(l.startTime) {
+		panic("token bucket clock returned implausible time " + l.startTime.String())
+	}
+	if l.minGrantRate > 0 {
+		if fillRate(fillInterval, quantum) < l.minGrantRate {
+			l.fillInterval, l.quantum = rateQuantum(l.minGrantRate)
+			l.requestedRate = l.minGrantRate
+		}
+		l.floor = NewLimiterWithRateAndClock(l.minGrantRate, capacity, clock)
+	}
+	l.lastGoodTime = l.startTime.UnixNano()
+	if l.monotonic {
+		mc, ok := clock.(MonotonicClock)
+		if !ok {
+			panic("token bucket clock is not monotonic")
+		}
+		l.monoBase = l.startTime
+		l.monoStart = mc.Monotonic()
+	}
+	return l
+}
+
+// now returns the current time according to the limiter's clock.
+func (l *Limiter) now() time.Time {
+	if l.monotonic {
+		return l.monoBase.Add(l.clock.(MonotonicClock).Monotonic() - l.monoStart)
+	}
+	return l.guardTime(l.clock.Now())
 }
 
 func (l *Limiter) Capacity() int64 {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
 	return l.capacity
 }
 
+// SetCapacity changes the capacity of the bucket, which must be
+// positive. Available tokens beyond the new capacity are dropped,
+// but tokens already reserved by callers waiting for them stay
+// reserved, so their waits end as originally returned.
+func (l *Limiter) SetCapacity(capacity int64) {
+	if capacity <= 0 {
+		panic("token bucket capacity is not > 0")
+	}
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	l.setCapacity(l.now(), capacity)
+}
+
+// setCapacity is the internal version of SetCapacity - it takes the
+// current time as an argument to enable easy testing.
+func (l *Limiter) setCapacity(now time.Time, capacity int64) {
+	l.adjustAvailableTokens(l.currentTick(now))
+	l.capacity = capacity
+	if max := l.accrualCap(); l.availableTokens > max {
+		l.availableTokens = max
+	}
+}
+
+// accrualCap returns the number of tokens the bucket may accrue,
+// which is its capacity unless credits can still be banked beyond it.
+func (l *Limiter) accrualCap() int64 {
+	if l.creditMultiplier <= 1 || l.creditSpent {
+		return l.capacity
+	}
+	return int64(l.creditMultiplier * float64(l.capacity))
+}
+
+// SameConfig reports whether l and other have the same fill
+// interval, quantum and capacity, regardless of their state, such as
+// the tokens available.
+func (l *Limiter) SameConfig(other *Limiter) bool {
+	if l == other {
+		return true
+	}
+	return l.config() == other.config()
+}
+
+// limiterConfig holds the parameters of a Limiter compared by
+// SameConfig.
+type limiterConfig struct {
+	fillInterval time.Duration
+	quantum      int64
+	capacity     int64
+}
+
+// config returns the limiter's current parameters.
+func (l *Limiter) config() limiterConfig {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	return limiterConfig{l.fillInterval, l.quantum, l.capacity}
+}
+
 func (l *Limiter) Rate() float64 {
-	return 1e9 * float64(l.quantum) / float64(l.fillInterval)
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	return fillRate(l.fillInterval, l.quantum)
 }
 
-// Available returns the number of available tokens. It will be negative
+// RateError returns the relative error of the rate at which the
+// bucket actually fills, as reported by Rate, from the rate most
+// recently asked for, by NewLimiterWithRate, SetRate or the like.
+// It is positive if the bucket fills faster than asked. Its
+// magnitude is at most RateMargin, and at most 0.1% up to a million
+// tokens per second. It is zero for a limiter whose fill interval
+// and quantum were given directly.
+func (l *Limiter) RateError() float64 {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if l.requestedRate == 0 {
+		return 0
+	}
+	return (fillRate(l.fillInterval, l.quantum) - l.requestedRate) / l.requestedRate
+}
+
+// fillRate returns the rate, in tokens per second, of a bucket
+// that gains quantum tokens every fillInterval.
+func fillRate(fillInterval time.Duration, quantum int64) float64 {
+	return 1e9 * float64(quantum) / float64(fillInterval)
+}
+
+// SetRate changes the rate at which the bucket fills to rate
+// tokens per second, which must be positive. As with
+// NewLimiterWithRate, the actual rate may be up to 1% different.
+// Tokens accrued so far are kept and progress towards the next
+// tick carries over, while waits already returned by earlier takes
+// are not affected. It ends any ramp started by RampRate.
+func (l *Limiter) SetRate(rate float64) {
+	if rate <= 0 {
+		panic("token bucket rate is not > 0")
+	}
+	rate = l.grantRate(rate)
+	fillInterval, quantum := rateQuantum(rate)
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	l.rampGen++
+	l.setFill(l.now(), fillInterval, quantum)
+	l.requestedRate = rate
+}
+
+// setFill changes the fill interval and quantum of the bucket as
+// of the given time.
+func (l *Limiter) setFill(now time.Time, fillInterval time.Duration, quantum int64) {
+	l.adjustAvailableTokens(l.currentTick(now))
+	// Restart the ticks so that the next tick is as far along
+	// under the new interval as it was under the old one.
+	partial := float64(now.Sub(l.tickTime(l.latestTick))) / float64(l.fillInterval)
+	l.startTime = now.Add(-time.Duration(partial * float64(fillInterval)))
+	l.latestTick = 0
+	l.fillInterval = fillInterval
+	l.quantum = quantum
+}
+
+// HasBlocked reports whether any take has ever had to wait for its
+// tokens. It is a cheap signal that the limiter is actually
+// constraining its callers.
+func (l *Limiter) HasBlocked() bool {
+	return atomic.LoadInt32(&l.blocked) != 0
+}
+
+// LastTake returns the time at which the tokens of the most recent
+// successful take were granted, which is in the future for a take
+// that has to wait. It returns the zero time if no tokens have been
+// taken.
+func (l *Limiter) LastTake() time.Time {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	return l.lastTake
+}
+
+// LastSpacing returns the time between the grants of the two most
+// recent successful takes, or zero if there have been fewer than
+// two.
+func (l *Limiter) LastSpacing() time.Duration {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if l.prevTake.IsZero() {
+		return 0
+	}
+	return l.lastTake.Sub(l.prevTake)
+}
+
+// Available returns the number of available tokens. Tokens reserved by
+// Take and the like are deducted as soon as they are reserved, even
+// while their callers are still waiting for them, so the result never
+// counts tokens that are already spoken for, and it will be negative
 // when there are consumers waiting for tokens. Note that if this
 // returns greater than zero, it does not guarantee that calls that take
 // tokens from the buffer will succeed, as the number of available
 // tokens could have changed in the meantime. This method is intended
 // primarily for metrics reporting and debugging.
 func (l *Limiter) Available() int64 {
-	return l.available(l.clock.Now())
+	return l.available(l.now())
 }
 
 func (l *Limiter) available(now time.Time) int64 {
@@ -177,21 +536,97 @@ func (l *Limiter) available(now time.Time) int64 {
 	return l.availableTokens
 }
 
+// AvailableAt returns the number of tokens that will be available at
+// time t if no tokens are taken in the meantime, which is at most the
+// most the bucket can hold. A time in the past is treated as now. As
+// with Available, the result is negative while there are consumers
+// waiting for tokens that will not yet have accrued by t.
+func (l *Limiter) AvailableAt(t time.Time) int64 {
+	now := l.now()
+	if t.Before(now) {
+		t = now
+	}
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	l.adjustAvailableTokens(l.currentTick(now))
+	max := l.accrualCap()
+	if l.availableTokens >= max {
+		return l.availableTokens
+	}
+	ticks := l.currentTick(t) - l.latestTick
+	if ticks >= (max-l.availableTokens+l.quantum-1)/l.quantum {
+		return max
+	}
+	return l.availableTokens + ticks*l.quantum
+}
+
 const infinityDuration = time.Duration(0x7fffffffffffffff)
 
 // Take takes count tokens from the bucket without blocking. It returns
 // the time that the caller should wait until the tokens are actually
+// available. count may exceed the capacity of the bucket, in which
+// case the wait covers the accrual of all the tokens beyond those
 // available.
 //
 // Note that if the request is irrevocable - there is no way to return
 // tokens to the bucket once this method commits us to taking them.
+//
+// If the take would exceed the limiter's lifetime quota, no tokens
+// are taken and the wait returned is zero.
 func (l *Limiter) Take(count int64) time.Duration {
 	l.mtx.Lock()
-	defer l.mtx.Unlock()
-	d, _ := l.take(l.clock.Now(), count, infinityDuration)
+	defer l.unlock()
+	d, _ := l.take(l.now(), count, infinityDuration)
 	return d
 }
 
+// ReserveInfo is like Take, but also returns how many tokens are
+// already reserved ahead of this request - that is, taken by
+// earlier callers who are still waiting for them to become
+// available. Like TakeTraced, and unlike Take, it is subject to
+// WithAdmissionFilter and WithPenalty: a take they refuse takes
+// nothing, and its wait is zero.
+func (l *Limiter) ReserveInfo(count int64) (wait time.Duration, aheadTokens int64) {
+	wait, trace := l.TakeTraced(count)
+	return wait, trace.Ahead
+}
+
+// reserveInfo is the internal version of ReserveInfo - it takes the
+// current time as an argument to enable easy testing.
+func (l *Limiter) reserveInfo(now time.Time, count int64) (time.Duration, int64) {
+	wait, trace := l.takeTraced(now, count)
+	return wait, trace.Ahead
+}
+
+// TakeIfQueueBelow is like Take, except that it only takes tokens
+// from the bucket if fewer than maxAhead tokens are already reserved
+// ahead of the request by callers still waiting for them. If the
+// queue is that deep, it does nothing and reports false.
+func (l *Limiter) TakeIfQueueBelow(count int64, maxAhead int) (time.Duration, bool) {
+	floored, err := l.refusal(count, "")
+	if err != nil {
+		return 0, false
+	}
+	l.mtx.Lock()
+	defer l.unlock()
+	d, ok := l.takeIfQueueBelow(l.now(), count, maxAhead)
+	if ok && floored {
+		l.chargeFloor(count)
+	}
+	return d, ok
+}
+
+// takeIfQueueBelow is the internal version of TakeIfQueueBelow - it
+// takes the current time as an argument to enable easy testing.
+func (l *Limiter) takeIfQueueBelow(now time.Time, count int64, maxAhead int) (time.Duration, bool) {
+	l.adjustAvailableTokens(l.currentTick(now))
+	if -l.availableTokens >= int64(maxAhead) {
+		l.reject(count)
+		return 0, false
+	}
+	return l.take(now, count, infinityDuration)
+}
+
 // TakeMaxDuration is like Take, except that
 // it will only take tokens from the bucket if the wait
 // time for the tokens is no greater than maxWait.
@@ -202,44 +637,83 @@ func (l *Limiter) Take(count int64) time.Duration {
 // wait until the tokens are actually available, and reports
 // true.
 func (l *Limiter) TakeMaxDuration(count int64, maxWait time.Duration) (time.Duration, bool) {
+	floored, err := l.refusal(count, "")
+	if err != nil {
+		return 0, false
+	}
 	l.mtx.Lock()
-	defer l.mtx.Unlock()
-	return l.take(l.clock.Now(), count, maxWait)
+	defer l.unlock()
+	d, ok := l.take(l.now(), count, maxWait)
+	if ok && floored {
+		l.chargeFloor(count)
+	}
+	return d, ok
 }
 
 // TakeAvailable takes up to count immediately available tokens from the
 // bucket. It returns the number of tokens removed, or zero if there are
 // no available tokens. It does not block.
 func (l *Limiter) TakeAvailable(count int64) int64 {
+	floored, err := l.refusal(count, "")
+	if err != nil {
+		return 0
+	}
 	l.mtx.Lock()
-	defer l.mtx.Unlock()
-	return l.takeAvailable(l.clock.Now(), count)
+	defer l.unlock()
+	granted := l.takeAvailable(l.now(), count)
+	if floored {
+		l.chargeFloor(granted)
+	}
+	return granted
 }
 
 // takeAvailable is the internal version of TakeAvailable - it takes the
 // current time as an argument to enable easy testing.
 func (l *Limiter) takeAvailable(now time.Time, count int64) int64 {
+	granted := l.takeAvailableUnrecorded(now, count)
+	l.record(TakeRecord{Time: now, Count: count, UpTo: true, Granted: granted})
+	return granted
+}
+
+// takeAvailableUnrecorded is like takeAvailable, but does not
+// record the take for ExportHistory.
+func (l *Limiter) takeAvailableUnrecorded(now time.Time, count int64) int64 {
 	if count <= 0 {
 		return 0
 	}
+	if left := l.quotaLeft(); count > left {
+		if left <= 0 {
+			l.reject(count)
+			return 0
+		}
+		count = left
+	}
 
 	l.adjustAvailableTokens(l.currentTick(now))
-	if l.availableTokens <= 0 {
+	if l.availableTokens <= 0 || l.pacedAt(now, now, 1).After(now) {
+		l.reject(count)
 		return 0
 	}
 
 	if count > l.availableTokens {
 		count = l.availableTokens
 	}
-	l.availableTokens -= count
+	if l.burstInterval > 0 {
+		// Only one token at a time is due under the pace.
+		count = 1
+	}
+	l.consume(now, now, count)
 	return count
 }
 
 // Wait takes count tokens from the bucket, waiting until they are
-// available.
+// available. If the take would exceed the limiter's lifetime quota,
+// it returns straight away without taking any tokens; use
+// WaitContext, which returns ErrQuotaExhausted, to be told of the
+// rejection.
 func (l *Limiter) Wait(count int64) {
 	if d := l.Take(count); d > 0 {
-		l.clock.Sleep(d)
+		l.sleep(d)
 	}
 }
 
@@ -251,37 +725,162 @@ func (l *Limiter) Wait(count int64) {
 func (l *Limiter) WaitMaxDuration(count int64, maxWait time.Duration) bool {
 	d, ok := l.TakeMaxDuration(count, maxWait)
 	if ok {
-		l.clock.Sleep(d)
+		l.sleep(d)
 	}
 	return ok
 }
 
+// sleep waits for d to pass. Waits shorter than spinThreshold
+// spin on the clock, yielding the processor between checks, while
+// longer ones sleep for d rounded up to the timer resolution.
+func (l *Limiter) sleep(d time.Duration) {
+	if d < l.spinThreshold {
+		deadline := l.now().Add(d)
+		for l.now().Before(deadline) {
+			runtime.Gosched()
+		}
+		return
+	}
+	l.clock.Sleep(l.timerDuration(d))
+}
+
+// timerDuration returns d rounded up to the timer resolution given
+// by WithTimerResolution, if any.
+func (l *Limiter) timerDuration(d time.Duration) time.Duration {
+	if res := l.timerResolution; res > 0 && d <= infinityDuration-res {
+		d = (d + res - 1) / res * res
+	}
+	return d
+}
+
 // take is the internal version of Take - it takes the current time as
 // an argument to enable easy testing.
 func (l *Limiter) take(now time.Time, count int64, maxWait time.Duration) (time.Duration, bool) {
+	wait, ok := l.takeUnrecorded(now, count, maxWait)
+	r := TakeRecord{Time: now, Count: count, MaxWait: maxWait, Wait: wait}
+	if ok {
+		r.Granted = count
+	}
+	l.record(r)
+	return wait, ok
+}
+
+// takeUnrecorded is like take, but does not record the take for
+// ExportHistory.
+func (l *Limiter) takeUnrecorded(now time.Time, count int64, maxWait time.Duration) (time.Duration, bool) {
 	if count <= 0 {
 		return 0, true
 	}
+	if count > l.quotaLeft() {
+		l.reject(count)
+		return 0, false
+	}
 
 	tick := l.currentTick(now)
 	l.adjustAvailableTokens(tick)
-	avail := l.availableTokens - count
-	if avail >= 0 {
-		l.availableTokens = avail
-		return 0, true
+	endTime := now
+	if avail := l.availableTokens - count; avail < 0 {
+		endTick := tick + (-avail+l.quantum-1)/l.quantum
+		endTime = l.startTime.Add(time.Duration(endTick) * l.fillInterval)
 	}
-
-	endTick := tick + (-avail+l.quantum-1)/l.quantum
-	endTime := l.startTime.Add(time.Duration(endTick) * l.fillInterval)
+	endTime = l.pacedAt(now, endTime, count)
 	waitTime := endTime.Sub(now)
 	if waitTime > maxWait {
+		l.reject(count)
 		return 0, false
 	}
 
-	l.availableTokens = avail
+	l.consume(now, endTime, count)
+	if waitTime > 0 {
+		atomic.StoreInt32(&l.blocked, 1)
+	}
 	return waitTime, true
 }
 
+// consume removes count tokens from the bucket, which must
+// already be up to date as of now, for a take granted at the given
+// time, and notes whether doing so emptied the bucket.
+func (l *Limiter) consume(now, at time.Time, count int64) {
+	if l.availableTokens > 0 && l.availableTokens <= count {
+		l.emptied = true
+	}
+	l.availableTokens -= count
+	if l.creditMultiplier > 1 && l.availableTokens < l.capacity {
+		l.creditSpent = true
+	}
+	if l.burstInterval > 0 {
+		l.nextGrant = at.Add(l.burstInterval)
+	}
+	l.prevTake, l.lastTake = l.lastTake, at
+	l.stats.Takes++
+	l.stats.Granted += count
+	if wait := at.Sub(now); wait > 0 {
+		l.stats.Waited++
+		l.stats.WaitTime += wait
+	}
+	if l.history != nil {
+		l.history.add(takeEvent{
+			taken: now.UnixNano(),
+			at:    at.UnixNano(),
+			count: count,
+		})
+	}
+}
+
+// unlock releases l.mtx and then runs the callbacks that are due
+// because of the operation that held it.
+func (l *Limiter) unlock() {
+	l.release().run(l)
+}
+
+// reject notes that a take of count tokens has been rejected.
+// l.mtx must be held.
+func (l *Limiter) reject(count int64) {
+	l.rejected = true
+	l.rejectedCount, l.rejectedTag = count, l.tag
+}
+
+// dueCallbacks records what happened during an operation that held
+// l.mtx, to determine the callbacks to run once it is released.
+type dueCallbacks struct {
+	emptied, rejected bool
+	rejectedCount     int64
+	rejectedTag       string
+}
+
+// release releases l.mtx, returning the callbacks that are due
+// because of the operation that held it.
+func (l *Limiter) release() dueCallbacks {
+	due := dueCallbacks{
+		emptied:       l.emptied,
+		rejected:      l.rejected,
+		rejectedCount: l.rejectedCount,
+		rejectedTag:   l.rejectedTag,
+	}
+	l.emptied, l.rejected = false, false
+	l.rejectedCount, l.rejectedTag = 0, ""
+	if due.rejected {
+		l.stats.Rejected++
+	}
+	l.mtx.Unlock()
+	return due
+}
+
+// run runs the callbacks of l that are due. l.mtx must not be held.
+func (due dueCallbacks) run(l *Limiter) {
+	if due.emptied && l.onEmpty != nil {
+		l.onEmpty()
+	}
+	if due.rejected {
+		if l.onReject != nil {
+			l.onReject(due.rejectedCount, due.rejectedTag)
+		}
+		if l.penalty != nil {
+			l.penalty.TakeAvailable(1)
+		}
+	}
+}
+
 // currentTick returns the current time tick, measured
 // from tb.startTime.
 func (l *Limiter) currentTick(now time.Time) int64 {
@@ -289,18 +888,28 @@ func (l *Limiter) currentTick(now time.Time) int64 {
 }
 
 // adjustavailableTokens adjusts the current number of tokens
-// available in the bucket at the given time, which must
+// available in the bucket at the given time, which should
 // be in the future (positive) with respect to tb.latestTick.
+// Earlier ticks are ignored rather than taking tokens away.
 func (l *Limiter) adjustAvailableTokens(tick int64) {
 	lastTick := l.latestTick
+	if tick < lastTick {
+		return
+	}
 	l.latestTick = tick
-	if l.availableTokens >= l.capacity {
+	max := l.accrualCap()
+	if l.availableTokens >= max {
+		l.wasted += (tick - lastTick) * l.quantum
 		return
 	}
+	if l.availableTokens <= 0 {
+		l.recordEmpty(lastTick, tick)
+	}
 
 	l.availableTokens += (tick - lastTick) * l.quantum
-	if l.availableTokens > l.capacity {
-		l.availableTokens = l.capacity
+	if l.availableTokens > max {
+		l.wasted += l.availableTokens - max
+		l.availableTokens = max
 	}
 }
 
@@ -310,14 +919,34 @@ type Clock interface {
 	Sleep(time.Duration)
 }
 
+// MonotonicClock is implemented by clocks that can measure the
+// passing of time independently of changes to the wall clock.
+type MonotonicClock interface {
+	Clock
+
+	// Monotonic returns the time elapsed since an arbitrary
+	// fixed point.
+	Monotonic() time.Duration
+}
+
 // realClock implements Clock in terms of standard time functions.
 type realClock struct{}
 
+// realClockStart holds the fixed point realClock measures
+// monotonic time from.
+var realClockStart = time.Now()
+
 // Now implements Clock.Now by calling time.Now.
 func (realClock) Now() time.Time {
 	return time.Now()
 }
 
+// Monotonic implements MonotonicClock.Monotonic by calling
+// time.Since, which uses the monotonic clock reading.
+func (realClock) Monotonic() time.Duration {
+	return time.Since(realClockStart)
+}
+
 // Now implements Clock.Sleep by calling time.Sleep.
 func (realClock) Sleep(d time.Duration) {
 	time.Sleep(d)
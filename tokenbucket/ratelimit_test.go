@@ -1,8 +1,25 @@
 package tokenbucket
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"github.com/GodYY/ratelimit/leakybucket"
+	"github.com/andres-erbsen/clock"
 	gc "gopkg.in/check.v1"
 	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -11,6 +28,31 @@ func TestPackage(t *testing.T) {
 	gc.TestingT(t)
 }
 
+// fakeClock is a Clock whose Sleep advances the time rather
+// than blocking.
+type fakeClock struct {
+	mtx sync.Mutex
+	now time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Sleep(d time.Duration) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if d > 0 {
+		c.now = c.now.Add(d)
+	}
+}
+
 type rateLimitSuite struct{}
 
 var _ = gc.Suite(rateLimitSuite{})
@@ -322,7 +364,7 @@ func (rateLimitSuite) TestRate(c *gc.C) {
 
 func checkRate(c *gc.C, rate float64) {
 	l := NewLimiterWithRate(rate, 1<<62)
-	if !isCloseTo(l.Rate(), rate, rateMargin) {
+	if !isCloseTo(l.Rate(), rate, RateMargin) {
 		c.Fatalf("got %g want %v", l.Rate(), rate)
 	}
 
@@ -337,7 +379,7 @@ func checkRate(c *gc.C, rate float64) {
 	d, ok = l.take(l.startTime, l.quantum*2-l.quantum/2, infinityDuration)
 	c.Assert(ok, gc.Equals, true)
 	expectTime := 1e9 * float64(l.quantum) * 2 / rate
-	if !isCloseTo(float64(d), expectTime, rateMargin) {
+	if !isCloseTo(float64(d), expectTime, RateMargin) {
 		c.Fatalf("rate %g: got %g want %v", rate, float64(d), expectTime)
 	}
 }
@@ -412,8 +454,2310 @@ func BenchmarkWait(b *testing.B) {
 	}
 }
 
+func BenchmarkWaitSpin(b *testing.B) {
+	tb := NewLimiterWithRate(1e5, 1, WithSpinThreshold(time.Millisecond))
+	for i := b.N - 1; i >= 0; i-- {
+		tb.Wait(1)
+	}
+}
+
 func BenchmarkNewLimiter(b *testing.B) {
 	for i := b.N - 1; i >= 0; i-- {
 		NewLimiterWithRate(4e18, 1<<62)
 	}
 }
+
+func BenchmarkNewLimiterPrecomputed(b *testing.B) {
+	const rate = 3.7e17
+	b.Run("uncached", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			NewLimiterWithRate(rate+1, 1<<62)
+		}
+	})
+	PrecomputeRates(rate)
+	b.Run("cached", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			NewLimiterWithRate(rate, 1<<62)
+		}
+	})
+}
+
+func TestPrecomputeRates(t *testing.T) {
+	rates := []float64{0.5, 12345.678, 3e9, 4e18}
+	c := newFakeClock()
+	var uncached []*Limiter
+	for _, rate := range rates {
+		uncached = append(uncached, NewLimiterWithRateAndClock(rate, 100, c))
+	}
+	PrecomputeRates(rates...)
+	for i, rate := range rates {
+		if _, ok := cachedRateQuantum(rate); !ok {
+			t.Fatalf("rate %g not cached", rate)
+		}
+		cached := NewLimiterWithRateAndClock(rate, 100, c)
+		if !reflect.DeepEqual(cached, uncached[i]) {
+			t.Fatalf("rate %g: cached limiter %+v differs from uncached %+v", rate, cached, uncached[i])
+		}
+	}
+}
+
+func TestFitLimiter(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	var samples []time.Time
+	for at := start; len(samples) < 20000; {
+		at = at.Add(time.Duration(rng.ExpFloat64() / 100 * 1e9))
+		samples = append(samples, at)
+	}
+
+	for _, target := range []float64{0, 0.1, 0.5} {
+		l := FitLimiter(samples, target)
+		got := rejectRate(samples, l.Rate())
+		if math.Abs(got-target) > 0.01 {
+			t.Fatalf("target %g: fitted rate %g rejects %g", target, l.Rate(), got)
+		}
+		if target > 0 && l.Rate() >= 100 {
+			t.Fatalf("target %g: fitted rate %g, want below the arrival rate", target, l.Rate())
+		}
+		if l.Capacity() != fitCapacity(l.Rate()) {
+			t.Fatalf("target %g: capacity %d, want %d", target, l.Capacity(), fitCapacity(l.Rate()))
+		}
+	}
+
+	// With two samples, any rate rejects at most half of them.
+	l := FitLimiter(samples[:2], 0.5)
+	if rate := l.Rate(); rate < minFitRate || rate > minFitRate*(1+RateMargin) {
+		t.Fatalf("two samples: fitted rate %g, want %g", rate, minFitRate)
+	}
+}
+
+func TestCreditCap(t *testing.T) {
+	c := newFakeClock()
+	l := NewLimiterWithClock(time.Second, 10, c, WithCreditCap(3))
+	if avail := l.Available(); avail != 10 {
+		t.Fatalf("initially: available = %d, want 10", avail)
+	}
+
+	c.Sleep(time.Hour)
+	if avail := l.Available(); avail != 30 {
+		t.Fatalf("after idling: available = %d, want 30", avail)
+	}
+	if d := l.Take(25); d != 0 {
+		t.Fatalf("burst of banked credits waited %v, want none", d)
+	}
+	if avail := l.Available(); avail != 5 {
+		t.Fatalf("after burst: available = %d, want 5", avail)
+	}
+	if d := l.Take(6); d != time.Second {
+		t.Fatalf("after spending credits: wait = %v, want 1s", d)
+	}
+	c.Sleep(time.Hour)
+	if avail := l.Available(); avail != 10 {
+		t.Fatalf("idling after spending credits: available = %d, want 10", avail)
+	}
+
+	l = NewLimiterWithClock(time.Second, 10, c)
+	c.Sleep(time.Hour)
+	if avail := l.Available(); avail != 10 {
+		t.Fatalf("without credits: available = %d, want 10", avail)
+	}
+}
+
+func TestSettledAt(t *testing.T) {
+	c := newFakeClock()
+	l := NewLimiterWithRateAndClock(1, 100, c)
+	l.Take(100)
+	c.Sleep(10 * time.Second)
+	now := c.Now()
+	if at := l.SettledAt(100); !at.Equal(now.Add(90 * time.Second)) {
+		t.Fatalf("at the low rate: settled at %v, want %v", at.Sub(now), 90*time.Second)
+	}
+
+	l.SetRate(10)
+	if at := l.SettledAt(100); !at.Equal(now.Add(9 * time.Second)) {
+		t.Fatalf("at the high rate: settled at %v, want %v", at.Sub(now), 9*time.Second)
+	}
+	if at := l.SettledAt(5); !at.Equal(now) {
+		t.Fatalf("already settled: got %v, want now", at.Sub(now))
+	}
+	if at := l.SettledAt(101); !at.IsZero() {
+		t.Fatalf("beyond capacity: got %v, want zero time", at)
+	}
+}
+
+func TestStatsDelta(t *testing.T) {
+	c := newFakeClock()
+	l := NewLimiterWithClock(10*time.Millisecond, 5, c)
+	l.Take(3)
+	before := l.Stats()
+	if want := (Stats{Takes: 1, Granted: 3}); before != want {
+		t.Fatalf("stats = %+v, want %+v", before, want)
+	}
+
+	l.Take(4)
+	l.TakeAvailable(1)
+	l.TakeMaxDuration(1, 0)
+	c.Sleep(time.Second)
+	l.TakeAvailable(2)
+
+	want := Stats{
+		Takes:    2,
+		Granted:  6,
+		Rejected: 2,
+		Waited:   1,
+		WaitTime: 20 * time.Millisecond,
+	}
+	if delta := l.StatsDelta(before); delta != want {
+		t.Fatalf("delta = %+v, want %+v", delta, want)
+	}
+	if delta := l.StatsDelta(l.Stats()); delta != (Stats{}) {
+		t.Fatalf("delta from now = %+v, want zero", delta)
+	}
+}
+
+func TestRecorderReplay(t *testing.T) {
+	c := newFakeClock()
+	l := NewLimiterWithClock(10*time.Millisecond, 5, c, WithRecorder())
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 500; i++ {
+		count := rng.Int63n(4) + 1
+		switch rng.Intn(3) {
+		case 0:
+			l.Take(count)
+		case 1:
+			l.TakeMaxDuration(count, time.Duration(rng.Intn(30))*time.Millisecond)
+		case 2:
+			l.TakeAvailable(count)
+		}
+		c.Sleep(time.Duration(rng.Intn(15)) * time.Millisecond)
+	}
+
+	history := l.ExportHistory()
+	if len(history) != 500 {
+		t.Fatalf("recorded %d takes, want 500", len(history))
+	}
+	granted, rejected := 0, 0
+	for _, r := range history {
+		if r.Granted > 0 {
+			granted++
+		} else {
+			rejected++
+		}
+	}
+	if granted == 0 || rejected == 0 {
+		t.Fatalf("history has %d grants and %d rejections, want both", granted, rejected)
+	}
+
+	replayed := NewLimiterWithClock(10*time.Millisecond, 5, newFakeClock()).Replay(history)
+	if !reflect.DeepEqual(replayed, history) {
+		for i := range history {
+			if replayed[i] != history[i] {
+				t.Fatalf("take %d: replayed %+v, recorded %+v", i, replayed[i], history[i])
+			}
+		}
+	}
+	if NewLimiter(time.Second, 1).ExportHistory() != nil {
+		t.Fatalf("got history without a recorder")
+	}
+}
+
+func TestTokenLeakyConversion(t *testing.T) {
+	rate, per, slack := TokenToLeaky(7*time.Millisecond, 10)
+	if fi, capacity := LeakyToToken(rate, per, slack); fi != 7*time.Millisecond || capacity != 10 {
+		t.Fatalf("round trip gave %v, %d; want 7ms, 10", fi, capacity)
+	}
+
+	fi, capacity := LeakyToToken(250, time.Second, 4)
+	if rate, per, slack := TokenToLeaky(fi, capacity); per/time.Duration(rate) != time.Second/250 || slack != 4 {
+		t.Fatalf("round trip gave %d per %v with slack %d, want 250 per second with slack 4", rate, per, slack)
+	}
+
+	// Both limiters should let the same number of requests through
+	// over a long run.
+	const n = 2000
+	rate, per, slack = TokenToLeaky(fi, capacity)
+	leakyClock := newFakeClock()
+	leaky := leakybucket.New(rate, leakybucket.WithPer(per), leakybucket.WithSlack(slack), leakybucket.WithClock(leakyClock))
+	tokenClock := newFakeClock()
+	token := NewLimiterWithClock(fi, capacity, tokenClock)
+	for i := 0; i < n; i++ {
+		leaky.Take()
+		token.Wait(1)
+	}
+	leakyRate := n / leakyClock.Now().Sub(newFakeClock().Now()).Seconds()
+	tokenRate := n / tokenClock.Now().Sub(newFakeClock().Now()).Seconds()
+	if math.Abs(leakyRate-tokenRate)/tokenRate > 0.01 {
+		t.Fatalf("leaky bucket rate %g, token bucket rate %g", leakyRate, tokenRate)
+	}
+}
+
+func TestAvailableReflectsReservations(t *testing.T) {
+	c := newFakeClock()
+	l := NewLimiterWithClock(time.Second, 10, c)
+	l.Take(5)
+	if avail := l.Available(); avail != 5 {
+		t.Fatalf("after reserving 5: available = %d, want 5", avail)
+	}
+	if d := l.Take(8); d != 3*time.Second {
+		t.Fatalf("wait = %v, want 3s", d)
+	}
+	if avail := l.Available(); avail != -3 {
+		t.Fatalf("with waiters: available = %d, want -3", avail)
+	}
+	c.Sleep(time.Second)
+	if avail := l.Available(); avail != -2 {
+		t.Fatalf("after a second: available = %d, want -2", avail)
+	}
+}
+
+func TestAdmissionFilter(t *testing.T) {
+	var open int32
+	var requested []int64
+	l := NewLimiterWithClock(time.Second, 10, newFakeClock(), WithAdmissionFilter(func(count int64) bool {
+		requested = append(requested, count)
+		return atomic.LoadInt32(&open) != 0
+	}), WithCostTable(map[string]int64{"op": 2}))
+
+	if _, ok := l.TakeMaxDuration(1, time.Hour); ok {
+		t.Fatalf("TakeMaxDuration allowed by closed filter")
+	}
+	if n := l.TakeAvailable(3); n != 0 {
+		t.Fatalf("TakeAvailable took %d tokens through closed filter", n)
+	}
+	if _, ok := l.TakeIfQueueBelow(4, 10); ok {
+		t.Fatalf("TakeIfQueueBelow allowed by closed filter")
+	}
+	if err := l.WaitContext(context.Background(), 5); err != ErrVetoed {
+		t.Fatalf("WaitContext returned %v, want ErrVetoed", err)
+	}
+	if err := l.WaitOp("op"); err != ErrVetoed {
+		t.Fatalf("WaitOp returned %v, want ErrVetoed", err)
+	}
+	if avail := l.Available(); avail != 10 {
+		t.Fatalf("available = %d after vetoed takes, want 10", avail)
+	}
+	if !reflect.DeepEqual(requested, []int64{1, 3, 4, 5, 2}) {
+		t.Fatalf("filter saw counts %v", requested)
+	}
+	if rejected := l.Stats().Rejected; rejected != 5 {
+		t.Fatalf("rejected = %d, want 5", rejected)
+	}
+	if d, ahead := l.ReserveInfo(3); d != 0 || ahead != 0 {
+		t.Fatalf("ReserveInfo through closed filter: got %v, %d; want 0, 0", d, ahead)
+	}
+	if d, trace := l.TakeTraced(3); d != 0 || trace.Reserved != 0 || trace.Refused != ErrVetoed {
+		t.Fatalf("TakeTraced through closed filter: got %v, %+v; want nothing reserved and ErrVetoed", d, trace)
+	}
+	if avail, rejected := l.Available(), l.Stats().Rejected; avail != 10 || rejected != 7 {
+		t.Fatalf("after vetoed traced takes: available = %d, rejected = %d, want 10 and 7", avail, rejected)
+	}
+
+	// Take cannot fail, so it is not filtered.
+	if d := l.Take(1); d != 0 {
+		t.Fatalf("Take through closed filter: wait = %v, want 0", d)
+	}
+	if avail := l.Available(); avail != 9 {
+		t.Fatalf("available = %d after Take through closed filter, want 9", avail)
+	}
+
+	atomic.StoreInt32(&open, 1)
+	if n := l.TakeAvailable(3); n != 3 {
+		t.Fatalf("TakeAvailable took %d tokens through open filter, want 3", n)
+	}
+	if d, trace := l.TakeTraced(3); d != 0 || trace.Reserved != 3 || trace.Refused != nil {
+		t.Fatalf("TakeTraced through open filter: got %v, %+v; want 3 reserved", d, trace)
+	}
+}
+
+var minCapacityForTests = []struct {
+	about          string
+	fillInterval   time.Duration
+	quantum        int64
+	demandPerSec   float64
+	maxBurstWindow time.Duration
+	expect         int64
+}{{
+	about:          "demand above rate",
+	fillInterval:   100 * time.Millisecond,
+	quantum:        1,
+	demandPerSec:   50,
+	maxBurstWindow: 2 * time.Second,
+	expect:         80,
+}, {
+	about:          "partial fill interval in window",
+	fillInterval:   300 * time.Millisecond,
+	quantum:        3,
+	demandPerSec:   20,
+	maxBurstWindow: time.Second,
+	expect:         11,
+}, {
+	about:          "fractional demand rounds up",
+	fillInterval:   time.Second,
+	quantum:        1,
+	demandPerSec:   2.5,
+	maxBurstWindow: 3 * time.Second,
+	expect:         5,
+}, {
+	about:          "demand below rate",
+	fillInterval:   10 * time.Millisecond,
+	quantum:        1,
+	demandPerSec:   50,
+	maxBurstWindow: time.Second,
+	expect:         1,
+}}
+
+func TestMinCapacityFor(t *testing.T) {
+	for i, test := range minCapacityForTests {
+		l := NewLimiterWithQuantum(test.fillInterval, test.quantum, 1)
+		if got := l.MinCapacityFor(test.demandPerSec, test.maxBurstWindow); got != test.expect {
+			t.Fatalf("test %d, %s: got %d, want %d", i, test.about, got, test.expect)
+		}
+	}
+}
+
+func TestView(t *testing.T) {
+	c := newFakeClock()
+	l := NewLimiterWithQuantumAndClock(100*time.Millisecond, 2, 10, c)
+	l.Take(3)
+	c.Sleep(50 * time.Millisecond)
+	l.Take(12)
+
+	v := l.View()
+	if !v.Time.Equal(c.Now()) {
+		t.Fatalf("view time %v, want %v", v.Time, c.Now())
+	}
+	if v.Available != v.Capacity-v.Stats.Granted {
+		t.Fatalf("available %d, want capacity %d less %d granted", v.Available, v.Capacity, v.Stats.Granted)
+	}
+	if v.Rate != fillRate(v.FillInterval, v.Quantum) || v.Rate != 20 {
+		t.Fatalf("rate %g inconsistent with %v and quantum %d", v.Rate, v.FillInterval, v.Quantum)
+	}
+	if want := v.Time.Add(250 * time.Millisecond); !v.LastTake.Equal(want) || v.Stats.WaitTime != want.Sub(v.Time) {
+		t.Fatalf("last take %v and wait time %v, want %v", v.LastTake.Sub(v.Time), v.Stats.WaitTime, want.Sub(v.Time))
+	}
+	if v.Stats.Takes != 2 {
+		t.Fatalf("takes = %d, want 2", v.Stats.Takes)
+	}
+
+	l = NewLimiterWithQuantumAndClock(100*time.Millisecond, 2, 10, c)
+	c.Sleep(time.Second)
+	if v := l.View(); v.Wasted != 20 || v.Available != 10 {
+		t.Fatalf("idle full bucket: wasted %d and available %d, want 20 and 10", v.Wasted, v.Available)
+	}
+}
+
+func TestQuantizeRate(t *testing.T) {
+	for _, rate := range []float64{0.3, 1, 3, 333.3, 12345.678, 1e9, 3e11, 4e18} {
+		actual, fillInterval, quantum := QuantizeRate(rate)
+		if got := NewLimiterWithQuantum(fillInterval, quantum, 1).Rate(); got != actual {
+			t.Fatalf("rate %g: constructed rate %g, want exactly %g", rate, got, actual)
+		}
+		if got := NewLimiterWithRate(rate, 1).Rate(); got != actual {
+			t.Fatalf("rate %g: NewLimiterWithRate rate %g, want exactly %g", rate, got, actual)
+		}
+		if math.Abs(actual-rate)/rate > RateMargin {
+			t.Fatalf("rate %g: actual rate %g is off by more than %g", rate, actual, RateMargin)
+		}
+	}
+}
+
+func TestLifetimeQuota(t *testing.T) {
+	c := newFakeClock()
+	l := NewLimiterWithClock(time.Second, 10, c, WithLifetimeQuota(25), WithCostTable(map[string]int64{"op": 1}))
+	for i := 0; i < 6; i++ {
+		d, ok := l.TakeMaxDuration(4, time.Hour)
+		if !ok {
+			t.Fatalf("take %d rejected within quota", i)
+		}
+		c.Sleep(d)
+	}
+	if _, ok := l.TakeMaxDuration(4, time.Hour); ok {
+		t.Fatalf("take beyond quota allowed")
+	}
+	c.Sleep(time.Hour)
+	if n := l.TakeAvailable(4); n != 1 {
+		t.Fatalf("TakeAvailable took %d tokens, want the 1 left in the quota", n)
+	}
+	if n := l.TakeAvailable(1); n != 0 {
+		t.Fatalf("TakeAvailable took %d tokens after quota, want 0", n)
+	}
+	if err := l.WaitContext(context.Background(), 1); err != ErrQuotaExhausted {
+		t.Fatalf("WaitContext returned %v, want ErrQuotaExhausted", err)
+	}
+	if err := l.WaitOp("op"); err != ErrQuotaExhausted {
+		t.Fatalf("WaitOp returned %v, want ErrQuotaExhausted", err)
+	}
+	if granted := l.Stats().Granted; granted != 25 {
+		t.Fatalf("granted = %d, want the quota of 25", granted)
+	}
+	if avail := l.Available(); avail != 9 {
+		t.Fatalf("available = %d, want 9", avail)
+	}
+	if d := l.Take(1); d != 0 {
+		t.Fatalf("Take after quota: wait = %v, want 0", d)
+	}
+	if d, trace := l.TakeTraced(1); d != 0 || trace.Refused != ErrQuotaExhausted {
+		t.Fatalf("TakeTraced after quota: got %v, %+v; want ErrQuotaExhausted", d, trace)
+	}
+	l.Wait(1)
+	if granted, avail := l.Stats().Granted, l.Available(); granted != 25 || avail != 9 {
+		t.Fatalf("after takes beyond quota: granted = %d, available = %d, want 25 and 9", granted, avail)
+	}
+}
+
+func TestGrantedSizeHistogram(t *testing.T) {
+	l := NewLimiterWithClock(time.Second, 10, newFakeClock(), WithGrantedSizeHistogram())
+	l.TakeAvailable(4)
+	l.TakeMaxDuration(4, 0)
+	l.TakeAvailable(4)
+	l.TakeAvailable(1)
+	l.TakeMaxDuration(1, time.Hour)
+	l.TakeMaxDuration(8, 0)
+	l.TakeAvailable(0)
+
+	want := map[int64]SizeCount{
+		4: {Requested: 3, Full: 2, Partial: 1},
+		1: {Requested: 2, Full: 1},
+		8: {Requested: 1},
+	}
+	if got := l.GrantedSizeHistogram(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("histogram = %v, want %v", got, want)
+	}
+	if h := NewLimiter(time.Second, 1).GrantedSizeHistogram(); h != nil {
+		t.Fatalf("got histogram %v without the option", h)
+	}
+}
+
+// sleeperClock is a Clock whose Sleep blocks until the time is
+// advanced past its end, and which lets tests wait until a given
+// number of goroutines are sleeping.
+type sleeperClock struct {
+	mtx      sync.Mutex
+	now      time.Time
+	sleepers map[chan struct{}]time.Time
+}
+
+func newSleeperClock() *sleeperClock {
+	return &sleeperClock{
+		now:      time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+		sleepers: make(map[chan struct{}]time.Time),
+	}
+}
+
+func (c *sleeperClock) Now() time.Time {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.now
+}
+
+func (c *sleeperClock) Sleep(d time.Duration) {
+	ch := make(chan struct{})
+	c.mtx.Lock()
+	c.sleepers[ch] = c.now.Add(d)
+	c.mtx.Unlock()
+	<-ch
+}
+
+// add advances the time by d, waking the sleepers whose sleep ends.
+func (c *sleeperClock) add(d time.Duration) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.now = c.now.Add(d)
+	for ch, end := range c.sleepers {
+		if !end.After(c.now) {
+			delete(c.sleepers, ch)
+			close(ch)
+		}
+	}
+}
+
+// waitSleepers waits until at least n goroutines are sleeping.
+func (c *sleeperClock) waitSleepers(t *testing.T, n int) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		c.mtx.Lock()
+		sleeping := len(c.sleepers)
+		c.mtx.Unlock()
+		if sleeping >= n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d goroutines sleeping, want %d", sleeping, n)
+		}
+		time.Sleep(100 * time.Microsecond)
+	}
+}
+
+func TestRampRate(t *testing.T) {
+	c := newSleeperClock()
+	l := NewLimiterWithRateAndClock(10, 10, c)
+	step := 10 * time.Second / rampSteps
+	advance := func(steps int) {
+		for i := 0; i < steps; i++ {
+			c.waitSleepers(t, 1)
+			c.add(step)
+		}
+	}
+	// Mid-ramp, the ramp has applied a step once it sleeps again.
+	// At the end it just stops, so approx allows it time to catch up.
+	approx := func(what string, want float64) {
+		var got float64
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(100 * time.Microsecond) {
+			if got = l.Rate(); math.Abs(got-want)/want <= 2*RateMargin {
+				return
+			}
+		}
+		t.Fatalf("%s: rate = %g, want about %g", what, got, want)
+	}
+
+	l.RampRate(110, 10*time.Second)
+	advance(rampSteps / 2)
+	c.waitSleepers(t, 1)
+	approx("midway", 60)
+	advance(rampSteps / 2)
+	approx("at the end", 110)
+	c.add(time.Second)
+	approx("after the end", 110)
+
+	l.RampRate(10, 10*time.Second)
+	advance(rampSteps / 4)
+	c.waitSleepers(t, 1)
+	approx("a quarter of the way down", 85)
+	l.RampRate(85+50, 10*time.Second)
+	c.waitSleepers(t, 2)
+	advance(rampSteps / 2)
+	c.waitSleepers(t, 1)
+	approx("midway through the retargeted ramp", 110)
+
+	l.SetRate(5)
+	c.add(10 * time.Second)
+	approx("after SetRate", 5)
+
+	// A ramp starts from the rate asked for, not the rate that
+	// approximates it.
+	const rate = 9.99e8
+	if actual, _, _ := QuantizeRate(rate); actual == rate {
+		t.Fatalf("rate %g is represented exactly", rate)
+	}
+	l = NewLimiterWithRateAndClock(rate, 10, c)
+	l.RampRate(2*rate, 10*time.Second)
+	advance(1)
+	c.waitSleepers(t, 1)
+	l.mtx.Lock()
+	got := l.requestedRate
+	l.mtx.Unlock()
+	if want := rate + rate/rampSteps; math.Abs(got-want) > want*1e-12 {
+		t.Fatalf("after one step: requested rate = %g, want %g", got, want)
+	}
+}
+
+func TestAllowTagged(t *testing.T) {
+	type rejection struct {
+		count int64
+		tag   string
+	}
+	var rejections []rejection
+	vetoBig := func(count int64) bool { return count < 100 }
+	l := NewLimiterWithClock(time.Second, 5, newFakeClock(), WithRecorder(), WithAdmissionFilter(vetoBig), WithOnReject(func(count int64, tag string) {
+		rejections = append(rejections, rejection{count, tag})
+	}))
+
+	if !l.AllowTagged(3, "req-1") {
+		t.Fatalf("tagged take within capacity rejected")
+	}
+	if l.AllowTagged(3, "req-2") {
+		t.Fatalf("tagged take beyond available allowed")
+	}
+	l.TakeAvailable(3)
+	l.TakeAvailable(1)
+	if l.AllowTagged(100, "req-3") {
+		t.Fatalf("vetoed tagged take allowed")
+	}
+
+	want := []rejection{{3, "req-2"}, {1, ""}, {100, "req-3"}}
+	if !reflect.DeepEqual(rejections, want) {
+		t.Fatalf("rejections = %v, want %v", rejections, want)
+	}
+	var tags []string
+	for _, r := range l.ExportHistory() {
+		tags = append(tags, r.Tag)
+	}
+	if want := []string{"req-1", "req-2", "", ""}; !reflect.DeepEqual(tags, want) {
+		t.Fatalf("recorded tags %q, want %q", tags, want)
+	}
+}
+
+func TestSameConfig(t *testing.T) {
+	a := NewLimiterWithQuantum(time.Second, 2, 10)
+	b := NewLimiterWithQuantum(time.Second, 2, 10)
+	b.TakeAvailable(7)
+	if !a.SameConfig(b) || !b.SameConfig(a) || !a.SameConfig(a) {
+		t.Fatalf("limiters with the same config and different available tokens reported different")
+	}
+	for i, other := range []*Limiter{
+		NewLimiterWithQuantum(2*time.Second, 2, 10),
+		NewLimiterWithQuantum(time.Second, 1, 10),
+		NewLimiterWithQuantum(time.Second, 2, 11),
+	} {
+		if a.SameConfig(other) {
+			t.Fatalf("limiter %d with a different config reported the same", i)
+		}
+	}
+	b.SetCapacity(11)
+	if a.SameConfig(b) {
+		t.Fatalf("limiter reported the same config after SetCapacity")
+	}
+}
+
+// brokenClock is a fakeClock that returns the zero time once
+// broken is set.
+type brokenClock struct {
+	fakeClock
+	broken bool
+}
+
+func (c *brokenClock) Now() time.Time {
+	if c.broken {
+		return time.Time{}
+	}
+	return c.fakeClock.Now()
+}
+
+func TestClockGuard(t *testing.T) {
+	c := &brokenClock{fakeClock: *newFakeClock()}
+	l := NewLimiterWithClock(time.Second, 10, c)
+	l.Take(10)
+	c.broken = true
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatalf("zero time did not panic by default")
+			}
+		}()
+		l.Available()
+	}()
+
+	c.broken = false
+	l = NewLimiterWithClock(time.Second, 10, c, WithClockGuard(ClockGuardClamp))
+	l.Take(10)
+	c.Sleep(3 * time.Second)
+	if avail := l.Available(); avail != 3 {
+		t.Fatalf("before breaking: available = %d, want 3", avail)
+	}
+	c.broken = true
+	if avail := l.Available(); avail != 3 {
+		t.Fatalf("with zero time: available = %d, want 3", avail)
+	}
+	if d := l.Take(4); d != time.Second {
+		t.Fatalf("with zero time: wait = %v, want 1s", d)
+	}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatalf("creating a limiter with a broken clock did not panic")
+			}
+		}()
+		NewLimiterWithClock(time.Second, 10, c, WithClockGuard(ClockGuardClamp))
+	}()
+}
+
+func TestTimeToFirstReject(t *testing.T) {
+	l := NewLimiterWithClock(time.Second, 10, newFakeClock())
+	if d := l.TimeToFirstReject(context.Background(), 5); d != 2400*time.Millisecond {
+		t.Fatalf("time to first reject = %v, want 2.4s", d)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	requests := 0
+	l = NewLimiterWithClock(time.Millisecond, 10, newFakeClock(), WithAdmissionFilter(func(int64) bool {
+		if requests++; requests == 100 {
+			cancel()
+		}
+		return true
+	}))
+	if d := l.TimeToFirstReject(ctx, 5); d != infinityDuration {
+		t.Fatalf("with load below the rate: got %v, want infinity", d)
+	}
+}
+
+func TestSwap(t *testing.T) {
+	c := newFakeClock()
+	l := NewLimiterWithClock(time.Second, 5, c)
+	if d := l.Take(6); d != time.Second {
+		t.Fatalf("wait before swap = %v, want 1s", d)
+	}
+	next := NewLimiterWithQuantumAndClock(100*time.Millisecond, 2, 20, c)
+	next.Take(15)
+	c.Sleep(50 * time.Millisecond)
+
+	held := l
+	l.Swap(next)
+	if !held.SameConfig(next) {
+		t.Fatalf("swapped limiter has config %+v, want %+v", held.config(), next.config())
+	}
+	if avail := held.Available(); avail != 5 {
+		t.Fatalf("swapped limiter has %d available, want 5", avail)
+	}
+	if d := held.Take(7); d != 50*time.Millisecond {
+		t.Fatalf("wait after swap = %v, want 50ms", d)
+	}
+	if avail := next.Available(); avail != 5 {
+		t.Fatalf("swap changed other: %d available, want 5", avail)
+	}
+	c.Sleep(50 * time.Millisecond)
+	if avail := held.Available(); avail != 0 {
+		t.Fatalf("after the reservation: %d available, want 0", avail)
+	}
+
+	// The rest of the state of the bucket comes from other too.
+	// held has spent its credit, emptied, wasted tokens and is
+	// pacing its grants; next has done none of these.
+	held = NewLimiterWithClock(time.Second, 5, c, WithCreditCap(2), WithMaxBurstRate(0.1))
+	next = NewLimiterWithClock(time.Second, 5, c)
+	held.Take(5)
+	c.Sleep(10 * time.Second)
+	if avail := held.Available(); avail != 5 {
+		t.Fatalf("before swap: %d available, want 5", avail)
+	}
+	if r := held.StarvationRatio(time.Minute); r == 0 {
+		t.Fatalf("before swap: starvation ratio = 0, want more")
+	}
+	held.Swap(next)
+	if r := held.StarvationRatio(time.Minute); r != 0 {
+		t.Fatalf("after swap: starvation ratio = %g, want 0", r)
+	}
+	if got, want := held.WastedTokens(), next.WastedTokens(); got != want {
+		t.Fatalf("after swap: %d tokens wasted, want %d", got, want)
+	}
+	c.Sleep(5 * time.Second)
+	if avail := held.Available(); avail != 10 {
+		t.Fatalf("after swap: %d available with credit, want 10", avail)
+	}
+	if n := held.TakeAvailable(1); n != 1 {
+		t.Fatalf("after swap: paced take got %d tokens, want 1", n)
+	}
+}
+
+func TestWorstCaseWait(t *testing.T) {
+	c := newFakeClock()
+	l := NewLimiterWithClock(100*time.Millisecond, 10, c)
+	if d := l.WorstCaseWait(5); d != 0 {
+		t.Fatalf("full bucket: worst case wait = %v, want 0", d)
+	}
+	l.Take(10)
+	accrual := l.WorstCaseWait(3)
+	if accrual != 300*time.Millisecond {
+		t.Fatalf("empty bucket: worst case wait = %v, want 300ms", accrual)
+	}
+
+	l.Take(4)
+	c.Sleep(50 * time.Millisecond)
+	wait := l.WorstCaseWait(3)
+	if wait <= accrual {
+		t.Fatalf("with reservations: worst case wait %v does not exceed accrual time %v", wait, accrual)
+	}
+	if d := l.Take(3); d != wait {
+		t.Fatalf("take waited %v, want the worst case wait %v", d, wait)
+	}
+
+	// Under pacing, a full bucket still releases its tokens one
+	// at a time.
+	l = NewLimiterWithClock(100*time.Millisecond, 10, c, WithMaxBurstRate(10))
+	if d := l.WorstCaseWait(5); d != 400*time.Millisecond {
+		t.Fatalf("paced: worst case wait = %v, want 400ms", d)
+	}
+	if d := l.Take(5); d != 400*time.Millisecond {
+		t.Fatalf("paced: take waited %v, want 400ms", d)
+	}
+	if d := l.WorstCaseWait(1); d != 500*time.Millisecond {
+		t.Fatalf("paced after take: worst case wait = %v, want 500ms", d)
+	}
+	if d := l.Take(1); d != 500*time.Millisecond {
+		t.Fatalf("paced after take: take waited %v, want 500ms", d)
+	}
+	if d := l.TimeToFull(); d != 600*time.Millisecond {
+		t.Fatalf("paced: time to full = %v, want 600ms", d)
+	}
+}
+
+func TestBlockRatio(t *testing.T) {
+	c := newFakeClock()
+	l := NewLimiterWithClock(10*time.Millisecond, 1, c, WithTakeHistory(1000))
+	for i := 0; i < 100; i++ {
+		l.Wait(1)
+	}
+	if r := l.BlockRatio(10 * time.Second); r < 0.95 {
+		t.Fatalf("saturated: block ratio = %g, want nearly 1", r)
+	}
+
+	c.Sleep(time.Minute)
+	for i := 0; i < 100; i++ {
+		l.Wait(1)
+		c.Sleep(20 * time.Millisecond)
+	}
+	if r := l.BlockRatio(time.Second); r != 0 {
+		t.Fatalf("idle: block ratio = %g, want 0", r)
+	}
+	c.Sleep(time.Minute)
+	if r := l.BlockRatio(time.Second); r != 0 {
+		t.Fatalf("no takes in window: block ratio = %g, want 0", r)
+	}
+	if r := NewLimiter(time.Second, 1).BlockRatio(time.Second); r != 0 {
+		t.Fatalf("without history: block ratio = %g, want 0", r)
+	}
+}
+
+var limiterFromEnvTests = []struct {
+	about        string
+	env          map[string]string
+	fillInterval time.Duration
+	quantum      int64
+	capacity     int64
+	expectErr    string
+}{{
+	about:        "rate",
+	env:          map[string]string{"TB_RATE": "250", "TB_BURST": "50"},
+	fillInterval: 4 * time.Millisecond,
+	quantum:      1,
+	capacity:     50,
+}, {
+	about:        "interval",
+	env:          map[string]string{"TB_INTERVAL": "1m30s", "TB_BURST": "3"},
+	fillInterval: 90 * time.Second,
+	quantum:      1,
+	capacity:     3,
+}, {
+	about:     "missing burst",
+	env:       map[string]string{"TB_RATE": "10"},
+	expectErr: "tokenbucket: TB_BURST is not set",
+}, {
+	about:     "malformed burst",
+	env:       map[string]string{"TB_RATE": "10", "TB_BURST": "ten"},
+	expectErr: `tokenbucket: TB_BURST is "ten", want a positive integer`,
+}, {
+	about:     "zero burst",
+	env:       map[string]string{"TB_RATE": "10", "TB_BURST": "0"},
+	expectErr: `tokenbucket: TB_BURST is "0", want a positive integer`,
+}, {
+	about:     "malformed rate",
+	env:       map[string]string{"TB_RATE": "fast", "TB_BURST": "1"},
+	expectErr: `tokenbucket: TB_RATE is "fast", want a positive, finite rate`,
+}, {
+	about:     "negative rate",
+	env:       map[string]string{"TB_RATE": "-5", "TB_BURST": "1"},
+	expectErr: `tokenbucket: TB_RATE is "-5", want a positive, finite rate`,
+}, {
+	about:     "infinite rate",
+	env:       map[string]string{"TB_RATE": "+Inf", "TB_BURST": "1"},
+	expectErr: `tokenbucket: TB_RATE is "+Inf", want a positive, finite rate`,
+}, {
+	about:     "unrepresentable rate",
+	env:       map[string]string{"TB_RATE": "1e24", "TB_BURST": "1"},
+	expectErr: `tokenbucket: TB_RATE is "1e24", want a rate of at most 5e+23 tokens per second`,
+}, {
+	about:     "malformed interval",
+	env:       map[string]string{"TB_INTERVAL": "5", "TB_BURST": "1"},
+	expectErr: `tokenbucket: TB_INTERVAL is "5", want a positive duration`,
+}, {
+	about:     "rate and interval",
+	env:       map[string]string{"TB_RATE": "5", "TB_INTERVAL": "1s", "TB_BURST": "1"},
+	expectErr: "tokenbucket: only one of TB_RATE and TB_INTERVAL may be set",
+}, {
+	about:     "neither rate nor interval",
+	env:       map[string]string{"TB_BURST": "1"},
+	expectErr: "tokenbucket: neither TB_RATE nor TB_INTERVAL is set",
+}}
+
+func TestNewLimiterFromEnv(t *testing.T) {
+	vars := []string{"TB_RATE", "TB_INTERVAL", "TB_BURST"}
+	defer func() {
+		for _, v := range vars {
+			os.Unsetenv(v)
+		}
+	}()
+	for i, test := range limiterFromEnvTests {
+		for _, v := range vars {
+			os.Unsetenv(v)
+		}
+		for k, v := range test.env {
+			os.Setenv(k, v)
+		}
+		l, err := NewLimiterFromEnv("TB")
+		if test.expectErr != "" {
+			if err == nil || err.Error() != test.expectErr {
+				t.Fatalf("test %d, %s: got error %v, want %q", i, test.about, err, test.expectErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("test %d, %s: unexpected error %v", i, test.about, err)
+		}
+		if l.fillInterval != test.fillInterval || l.quantum != test.quantum || l.Capacity() != test.capacity {
+			t.Fatalf("test %d, %s: got %v, %d, %d; want %v, %d, %d", i, test.about,
+				l.fillInterval, l.quantum, l.Capacity(), test.fillInterval, test.quantum, test.capacity)
+		}
+	}
+}
+
+func TestApproxEqualRate(t *testing.T) {
+	for _, rate := range []float64{1.1e-10, 1e-9, 0.5, 999999, 1e6, 12345.678, 1e12, 5e23} {
+		actual, _, _ := QuantizeRate(rate)
+		if !ApproxEqualRate(actual, rate) || !ApproxEqualRate(rate, actual) {
+			t.Fatalf("rate %g: actual rate %g not approximately equal", rate, actual)
+		}
+		if rate <= 1e6 && math.Abs(actual-rate)/rate > 0.001 {
+			t.Fatalf("rate %g: actual rate %g is off by more than 0.1%%", rate, actual)
+		}
+		if ApproxEqualRate(rate, rate*(1+2*RateMargin)) || ApproxEqualRate(rate*(1-2*RateMargin), rate) {
+			t.Fatalf("rate %g: rates 2%% apart are approximately equal", rate)
+		}
+	}
+	for _, rate := range []float64{1e-11, 1e24} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Fatalf("rate %g: no panic", rate)
+				}
+			}()
+			NewLimiterWithRate(rate, 1)
+		}()
+	}
+}
+
+func TestRampTo(t *testing.T) {
+	c := newSleeperClock()
+	l := NewLimiterWithClock(time.Hour, 100, c)
+	l.TakeAvailable(100)
+	step := 10 * time.Second / rampSteps
+	advance := func(steps int) {
+		for i := 0; i < steps; i++ {
+			c.waitSleepers(t, 1)
+			c.add(step)
+		}
+	}
+	l.RampTo(80, 10*time.Second)
+	advance(rampSteps / 2)
+	c.waitSleepers(t, 1)
+	if avail := l.Available(); avail != 40 {
+		t.Fatalf("midway: available %d, want 40", avail)
+	}
+	l.TakeAvailable(30)
+	advance(rampSteps / 4)
+	c.waitSleepers(t, 1)
+	if avail := l.Available(); avail != 60 {
+		t.Fatalf("three quarters of the way: available %d, want 60", avail)
+	}
+	advance(rampSteps / 4)
+	for deadline := time.Now().Add(5 * time.Second); l.Available() != 80; time.Sleep(100 * time.Microsecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("at the end: available %d, want 80", l.Available())
+		}
+	}
+
+	l.RampTo(1000, 0)
+	if avail := l.Available(); avail != 100 {
+		t.Fatalf("after immediate ramp: available %d, want 100", avail)
+	}
+}
+
+func TestAvailableAt(t *testing.T) {
+	c := newFakeClock()
+	l := NewLimiterWithQuantumAndClock(100*time.Millisecond, 2, 10, c)
+	l.TakeAvailable(10)
+	c.Sleep(50 * time.Millisecond)
+	now := c.Now()
+	for _, test := range []struct {
+		about string
+		t     time.Time
+		want  int64
+	}{
+		{"now", now, 0},
+		{"in the past", now.Add(-time.Hour), 0},
+		{"before the next tick", now.Add(49 * time.Millisecond), 0},
+		{"at the next tick", now.Add(50 * time.Millisecond), 2},
+		{"partway", now.Add(350 * time.Millisecond), 8},
+		{"when full", now.Add(450 * time.Millisecond), 10},
+		{"far in the future", now.Add(100 * 365 * 24 * time.Hour), 10},
+	} {
+		if got := l.AvailableAt(test.t); got != test.want {
+			t.Fatalf("%s: available %d, want %d", test.about, got, test.want)
+		}
+	}
+	if avail := l.Available(); avail != 0 {
+		t.Fatalf("AvailableAt changed available tokens to %d", avail)
+	}
+
+	l.Take(4)
+	if got := l.AvailableAt(now.Add(50 * time.Millisecond)); got != -2 {
+		t.Fatalf("with a reservation: available %d, want -2", got)
+	}
+}
+
+func TestMinGrantRate(t *testing.T) {
+	c := newFakeClock()
+	penalty := NewLimiterWithClock(time.Hour, 1, c)
+	l := NewLimiterWithRateAndClock(2, 1, c, WithPenalty(penalty), WithMinGrantRate(5), WithPressureRange(1, 20))
+	if r := l.Rate(); !ApproxEqualRate(r, 5) {
+		t.Fatalf("initial rate %g, want 5", r)
+	}
+	l.SetPressure(0)
+	if r := l.Rate(); !ApproxEqualRate(r, 5) {
+		t.Fatalf("rate at no pressure %g, want 5", r)
+	}
+	l.SetRate(20)
+	if r := l.Rate(); !ApproxEqualRate(r, 20) {
+		t.Fatalf("rate %g, want 20", r)
+	}
+
+	// Exhaust the penalty bucket, which never refills during the
+	// test, so that every take is penalized.
+	l.TakeAvailable(1)
+	l.TakeMaxDuration(1, 0)
+	if avail := penalty.Available(); avail != 0 {
+		t.Fatalf("penalty available %d, want 0", avail)
+	}
+	granted := 0
+	for i := 0; i < 1000; i++ {
+		c.Sleep(10 * time.Millisecond)
+		if _, ok := l.TakeMaxDuration(1, 0); ok {
+			granted++
+		}
+	}
+	if granted < 50 || granted > 51 {
+		t.Fatalf("granted %d takes in 10s while penalized, want about 50", granted)
+	}
+
+	// Swap cannot take the rate below the minimum either.
+	l.Swap(NewLimiterWithRateAndClock(1, 1, c))
+	if r := l.Rate(); !ApproxEqualRate(r, 5) {
+		t.Fatalf("rate after swap %g, want 5", r)
+	}
+
+	// A penalized take the bucket refuses leaves the minimum grant
+	// rate's allowance for the next one.
+	c = newFakeClock()
+	penalty = NewLimiterWithClock(time.Hour, 1, c)
+	l = NewLimiterWithRateAndClock(5, 1, c, WithPenalty(penalty), WithMinGrantRate(5))
+	l.TakeMaxDuration(2, 0)
+	l.Take(1)
+	if _, ok := l.TakeMaxDuration(1, 0); ok {
+		t.Fatalf("penalized take allowed from an empty bucket")
+	}
+	l.SetRate(10)
+	c.Sleep(100 * time.Millisecond)
+	if _, ok := l.TakeMaxDuration(1, 0); !ok {
+		t.Fatalf("penalized take refused once the bucket refilled")
+	}
+	if _, ok := l.TakeMaxDuration(1, 0); ok {
+		t.Fatalf("penalized take allowed beyond the minimum grant rate")
+	}
+}
+
+func TestRateError(t *testing.T) {
+	for _, rate := range []float64{0.5, 10, 100, 12345} {
+		if e := NewLimiterWithRate(rate, 1).RateError(); math.Abs(e) > 1e-4 {
+			t.Fatalf("rate %g: error %g, want near zero", rate, e)
+		}
+	}
+	for _, rate := range []float64{1e12, 3e11, 4e18} {
+		actual, _, _ := QuantizeRate(rate)
+		want := (actual - rate) / rate
+		if e := NewLimiterWithRate(rate, 1).RateError(); e != want || e == 0 {
+			t.Fatalf("rate %g: error %g, want %g", rate, e, want)
+		}
+	}
+
+	l := NewLimiterWithRate(100, 1)
+	l.SetRate(1e12)
+	if e := l.RateError(); math.Abs(e) < 0.001 {
+		t.Fatalf("after SetRate: error %g, want the deviation for 1e12", e)
+	}
+	if e := NewLimiterWithQuantum(3*time.Nanosecond, 1, 1).RateError(); e != 0 {
+		t.Fatalf("limiter with explicit quantum: error %g, want 0", e)
+	}
+}
+
+func TestCheckpointer(t *testing.T) {
+	c := newSleeperClock()
+	l := NewLimiterWithClock(time.Second, 10, c)
+	l.TakeAvailable(7)
+	path := filepath.Join(t.TempDir(), "limiter.state")
+	stop, err := l.StartCheckpointer(path, time.Second)
+	if err != nil {
+		t.Fatalf("cannot start checkpointer: %v", err)
+	}
+	l.TakeAvailable(2)
+	c.waitSleepers(t, 1)
+	c.add(time.Second)
+	// The checkpointer sleeps again once it has written the
+	// checkpoint.
+	c.waitSleepers(t, 1)
+
+	restored := NewLimiterWithClock(time.Second, 10, c)
+	if err := restored.RestoreFromCheckpoint(path); err != nil {
+		t.Fatalf("cannot restore checkpoint: %v", err)
+	}
+	if avail := restored.Available(); avail != 2 {
+		t.Fatalf("restored available %d, want 2", avail)
+	}
+	c.add(2 * time.Second)
+	if avail := restored.Available(); avail != 4 {
+		t.Fatalf("restored available %d after 2s, want 4", avail)
+	}
+
+	l.TakeAvailable(4)
+	if err := stop(); err != nil {
+		t.Fatalf("cannot write final checkpoint: %v", err)
+	}
+	if err := restored.RestoreFromCheckpoint(path); err != nil {
+		t.Fatalf("cannot restore final checkpoint: %v", err)
+	}
+	if avail := restored.Available(); avail != 0 {
+		t.Fatalf("available %d from final checkpoint, want 0", avail)
+	}
+	if matches, _ := filepath.Glob(path + ".tmp*"); len(matches) != 0 {
+		t.Fatalf("temporary files left behind: %v", matches)
+	}
+
+	// Once stopped, the checkpointer writes nothing more.
+	if err := os.Remove(path); err != nil {
+		t.Fatalf("cannot remove checkpoint: %v", err)
+	}
+	c.add(10 * time.Second)
+	time.Sleep(10 * time.Millisecond)
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("checkpoint written after stop: %v", err)
+	}
+
+	// stop reports an error writing the final checkpoint.
+	dir := filepath.Join(t.TempDir(), "gone")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatalf("cannot make directory: %v", err)
+	}
+	stop, err = l.StartCheckpointer(filepath.Join(dir, "limiter.state"), time.Second)
+	if err != nil {
+		t.Fatalf("cannot start checkpointer: %v", err)
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatalf("cannot remove directory: %v", err)
+	}
+	if err := stop(); err == nil {
+		t.Fatalf("final checkpoint to a removed directory succeeded")
+	}
+	if err := stop(); err == nil {
+		t.Fatalf("second stop did not repeat the error")
+	}
+
+	if err := restored.RestoreFromCheckpoint(path + ".missing"); err == nil {
+		t.Fatalf("restoring a missing checkpoint succeeded")
+	}
+	if _, err := l.StartCheckpointer(filepath.Join(path+".missing", "x"), time.Second); err == nil {
+		t.Fatalf("checkpointer started with an unwritable path")
+	}
+}
+
+func TestSustainableClients(t *testing.T) {
+	for _, test := range []struct {
+		fillInterval time.Duration
+		quantum      int64
+		demand       float64
+		want         int64
+	}{
+		// 100 tokens per second.
+		{10 * time.Millisecond, 1, 1, 100},
+		{10 * time.Millisecond, 1, 3, 33},
+		{10 * time.Millisecond, 1, 0.5, 200},
+		{10 * time.Millisecond, 1, 100, 1},
+		{10 * time.Millisecond, 1, 101, 0},
+		// 2.5 tokens per second.
+		{2 * time.Second, 5, 1, 2},
+		{2 * time.Second, 5, 0.25, 10},
+		{2 * time.Second, 5, 2.5, 1},
+		{2 * time.Second, 5, 3, 0},
+		// A negligible demand.
+		{time.Nanosecond, 1 << 40, 1e-300, math.MaxInt64},
+	} {
+		l := NewLimiterWithQuantum(test.fillInterval, test.quantum, 1)
+		if got := l.SustainableClients(test.demand); got != test.want {
+			t.Fatalf("rate %g, demand %g: %d clients, want %d", l.Rate(), test.demand, got, test.want)
+		}
+	}
+}
+
+func TestWastedTokens(t *testing.T) {
+	c := newFakeClock()
+	l := NewLimiterWithQuantumAndClock(100*time.Millisecond, 2, 10, c)
+	c.Sleep(time.Second)
+	if wasted := l.WastedTokens(); wasted != 20 {
+		t.Fatalf("idle full bucket wasted %d tokens in 1s, want 20", wasted)
+	}
+	l.TakeAvailable(5)
+	c.Sleep(300 * time.Millisecond)
+	if wasted := l.WastedTokens(); wasted != 21 {
+		t.Fatalf("refilled bucket wasted %d tokens, want 21", wasted)
+	}
+
+	l = NewLimiterWithQuantumAndClock(100*time.Millisecond, 2, 10, c)
+	l.TakeAvailable(10)
+	for i := 0; i < 100; i++ {
+		c.Sleep(100 * time.Millisecond)
+		l.TakeAvailable(2)
+	}
+	if wasted := l.WastedTokens(); wasted != 0 {
+		t.Fatalf("drained bucket wasted %d tokens, want 0", wasted)
+	}
+}
+
+func TestWriteMetrics(t *testing.T) {
+	c := newFakeClock()
+	l := NewLimiterWithClock(100*time.Millisecond, 10, c)
+	c.Sleep(time.Second)
+	l.TakeAvailable(4)
+	l.Take(8)
+	l.TakeMaxDuration(1, 0)
+	var buf bytes.Buffer
+	if err := l.WriteMetrics(&buf); err != nil {
+		t.Fatalf("cannot write metrics: %v", err)
+	}
+
+	// Check the output against the exposition format: each sample
+	// is preceded by the HELP and TYPE lines for its metric.
+	samples := make(map[string]string)
+	var help, kind string
+	for i, line := range strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n") {
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) >= 4 && fields[0] == "#" && fields[1] == "HELP":
+			help = fields[2]
+		case len(fields) == 4 && fields[0] == "#" && fields[1] == "TYPE":
+			if fields[2] != help || (fields[3] != "gauge" && fields[3] != "counter") {
+				t.Fatalf("line %d: bad TYPE line %q", i, line)
+			}
+			kind = fields[2]
+		case len(fields) == 2:
+			if fields[0] != kind || !metricNamePattern.MatchString(fields[0]) {
+				t.Fatalf("line %d: sample %q without HELP and TYPE", i, line)
+			}
+			if _, err := strconv.ParseFloat(fields[1], 64); err != nil {
+				t.Fatalf("line %d: bad value in %q", i, line)
+			}
+			samples[fields[0]] = fields[1]
+		default:
+			t.Fatalf("line %d: unexpected line %q", i, line)
+		}
+	}
+	want := map[string]string{
+		"tokenbucket_available_tokens":       "-2",
+		"tokenbucket_capacity_tokens":        "10",
+		"tokenbucket_rate_tokens_per_second": "10",
+		"tokenbucket_takes_total":            "2",
+		"tokenbucket_granted_tokens_total":   "12",
+		"tokenbucket_rejected_total":         "1",
+		"tokenbucket_waited_total":           "1",
+		"tokenbucket_wait_seconds_total":     "0.2",
+		"tokenbucket_wasted_tokens_total":    "10",
+	}
+	if !reflect.DeepEqual(samples, want) {
+		t.Fatalf("samples %v, want %v", samples, want)
+	}
+}
+
+var metricNamePattern = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+
+func TestMaxBurstRate(t *testing.T) {
+	c := newFakeClock()
+	l := NewLimiterWithClock(time.Hour, 10, c, WithMaxBurstRate(100))
+	for i := 0; i < 10; i++ {
+		if d, want := l.Take(1), time.Duration(i)*10*time.Millisecond; d != want {
+			t.Fatalf("take %d: wait %v, want %v", i, d, want)
+		}
+	}
+	if avail := l.Available(); avail != 0 {
+		t.Fatalf("available %d after draining, want 0", avail)
+	}
+
+	l = NewLimiterWithClock(time.Hour, 10, c, WithMaxBurstRate(100))
+	if n := l.TakeAvailable(3); n != 1 {
+		t.Fatalf("first take: got %d tokens, want 1", n)
+	}
+	if n := l.TakeAvailable(1); n != 0 {
+		t.Fatalf("take straight after the first got %d tokens, want 0", n)
+	}
+	if _, ok := l.TakeMaxDuration(1, 9*time.Millisecond); ok {
+		t.Fatalf("take with too short a wait succeeded")
+	}
+	c.Sleep(20 * time.Millisecond)
+	if d, ok := l.TakeMaxDuration(2, 10*time.Millisecond); !ok || d != 10*time.Millisecond {
+		t.Fatalf("paced take: wait %v, %v, want 10ms, true", d, ok)
+	}
+	c.Sleep(10 * time.Millisecond)
+	if n := l.TakeAvailable(1); n != 0 {
+		t.Fatalf("take with the last token of the one before got %d tokens, want 0", n)
+	}
+	c.Sleep(10 * time.Millisecond)
+	if n := l.TakeAvailable(1); n != 1 {
+		t.Fatalf("take once paced got %d tokens, want 1", n)
+	}
+
+	// A take of many tokens from a full bucket is granted with the
+	// last of them.
+	l = NewLimiterWithClock(time.Hour, 10, c, WithMaxBurstRate(100))
+	if d := l.Take(10); d != 90*time.Millisecond {
+		t.Fatalf("take of a full bucket: wait %v, want 90ms", d)
+	}
+	l = NewLimiterWithClock(time.Hour, 10, c, WithMaxBurstRate(1e9/(1<<62)))
+	if _, ok := l.TakeMaxDuration(5, time.Hour); ok {
+		t.Fatalf("take of tokens paced beyond the longest duration succeeded")
+	}
+	l = NewLimiterWithClock(time.Hour, 10, c, WithMaxBurstRate(1e9))
+	if d := l.Take(10); d != 9*time.Nanosecond {
+		t.Fatalf("take at the highest burst rate: wait %v, want 9ns", d)
+	}
+	for _, perSec := range []float64{0, 2e9, 1e-10} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Fatalf("WithMaxBurstRate(%g) did not panic", perSec)
+				}
+			}()
+			WithMaxBurstRate(perSec)
+		}()
+	}
+
+	l = NewLimiterWithClock(time.Hour, 10, c)
+	for i := 0; i < 10; i++ {
+		if d := l.Take(1); d != 0 {
+			t.Fatalf("take %d without smoothing: wait %v, want 0", i, d)
+		}
+	}
+}
+
+func TestStarvationRatio(t *testing.T) {
+	mock := clock.NewMock()
+	l := NewLimiterWithClock(10*time.Millisecond, 10, mock)
+	l.Take(10)
+	for i := 0; i < 100; i++ {
+		mock.Add(10 * time.Millisecond)
+		l.TakeAvailable(10)
+	}
+	if r := l.StarvationRatio(time.Second); !isCloseTo(r, 1, 0.05) {
+		t.Fatalf("drained bucket: starvation ratio = %v, want ~1", r)
+	}
+
+	mock = clock.NewMock()
+	l = NewLimiterWithClock(10*time.Millisecond, 10, mock)
+	for i := 0; i < 100; i++ {
+		mock.Add(10 * time.Millisecond)
+		l.TakeAvailable(1)
+	}
+	if r := l.StarvationRatio(time.Second); r != 0 {
+		t.Fatalf("idle bucket: starvation ratio = %v, want 0", r)
+	}
+}
+
+// tickingClock is a Clock whose time advances by step each time
+// it is read, and which records the durations it is asked to sleep.
+type tickingClock struct {
+	fakeClock
+	step   time.Duration
+	sleeps []time.Duration
+}
+
+func (c *tickingClock) Now() time.Time {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.now = c.now.Add(c.step)
+	return c.now
+}
+
+func (c *tickingClock) Sleep(d time.Duration) {
+	c.fakeClock.Sleep(d)
+	c.sleeps = append(c.sleeps, d)
+}
+
+func TestSpinThreshold(t *testing.T) {
+	const wait = 200 * time.Microsecond
+	c := &tickingClock{fakeClock: *newFakeClock(), step: time.Microsecond}
+	l := NewLimiterWithClock(time.Millisecond, 1, c)
+	l.sleep(wait)
+	if !reflect.DeepEqual(c.sleeps, []time.Duration{wait}) {
+		t.Fatalf("without spinning: slept %v, want [%v]", c.sleeps, wait)
+	}
+
+	c = &tickingClock{fakeClock: *newFakeClock(), step: time.Microsecond}
+	l = NewLimiterWithClock(time.Millisecond, 1, c, WithSpinThreshold(time.Millisecond))
+	start := c.Now()
+	l.sleep(wait)
+	if len(c.sleeps) != 0 {
+		t.Fatalf("spinning wait slept %v", c.sleeps)
+	}
+	if d := c.Now().Sub(start); d < wait || d > wait+3*c.step {
+		t.Fatalf("spinning wait took %v, want %v", d, wait)
+	}
+	l.sleep(time.Millisecond)
+	if !reflect.DeepEqual(c.sleeps, []time.Duration{time.Millisecond}) {
+		t.Fatalf("wait at the threshold slept %v, want [1ms]", c.sleeps)
+	}
+}
+
+func TestNotifyAvailable(t *testing.T) {
+	c := newSleeperClock()
+	l := NewLimiterWithClock(10*time.Millisecond, 10, c)
+	l.Take(10)
+	ch := l.NotifyAvailable(context.Background(), 5)
+
+	// The watcher has checked the bucket once it sleeps again.
+	c.waitSleepers(t, 1)
+	c.add(40 * time.Millisecond)
+	c.waitSleepers(t, 1)
+	select {
+	case <-ch:
+		t.Fatalf("notified with %d tokens available, want 5", l.Available())
+	default:
+	}
+	c.add(10 * time.Millisecond)
+	select {
+	case _, ok := <-ch:
+		if !ok {
+			t.Fatalf("channel closed rather than notified")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("not notified with %d tokens available", l.Available())
+	}
+	select {
+	case <-ch:
+		t.Fatalf("notified more than once")
+	default:
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	l.Take(10)
+	ch = l.NotifyAvailable(ctx, 5)
+	c.waitSleepers(t, 1)
+	cancel()
+	select {
+	case _, ok := <-ch:
+		if ok {
+			t.Fatalf("notified after cancellation")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("channel not closed after cancellation")
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	ch = l.NotifyAvailable(ctx, 11)
+	cancel()
+	if _, ok := <-ch; ok {
+		t.Fatalf("notified of more tokens than the capacity")
+	}
+}
+
+func TestExpectedWait(t *testing.T) {
+	l := NewLimiterWithRate(1000, 1)
+	if d := l.ExpectedWait(10); d > 10*time.Microsecond {
+		t.Fatalf("light load: expected wait = %v, want ~0", d)
+	}
+	prev := l.ExpectedWait(900)
+	for _, offered := range []float64{990, 999, 999.9, 1000, 1001, 1010, 1100, 2000} {
+		d := l.ExpectedWait(offered)
+		if d <= prev {
+			t.Fatalf("offered %v: expected wait = %v, want more than %v", offered, d, prev)
+		}
+		prev = d
+	}
+	if d := l.ExpectedWait(1001); d > time.Second {
+		t.Fatalf("slight overload: expected wait = %v, want well under a second", d)
+	}
+	// At twice the rate, the request arriving at the end of the
+	// minute queues behind a minute's worth of backlog, so the
+	// average is about 30s.
+	if d := l.ExpectedWait(2000); d < 30*time.Second || d > 31*time.Second {
+		t.Fatalf("double load: expected wait = %v, want about 30s", d)
+	}
+	if d := l.ExpectedWait(math.MaxFloat64); d != infinityDuration {
+		t.Fatalf("unbounded load: expected wait = %v, want infinity", d)
+	}
+}
+
+func TestOnEmpty(t *testing.T) {
+	mock := clock.NewMock()
+	emptied := 0
+	l := NewLimiterWithClock(10*time.Millisecond, 10, mock, WithOnEmpty(func() {
+		emptied++
+	}))
+
+	l.TakeAvailable(4)
+	if emptied != 0 {
+		t.Fatalf("after partial take: emptied %d times, want 0", emptied)
+	}
+	l.TakeAvailable(6)
+	if emptied != 1 {
+		t.Fatalf("after draining: emptied %d times, want 1", emptied)
+	}
+	l.Take(1)
+	l.TakeAvailable(1)
+	if emptied != 1 {
+		t.Fatalf("after taking from empty bucket: emptied %d times, want 1", emptied)
+	}
+
+	mock.Add(100 * time.Millisecond)
+	if _, ok := l.TakeMaxDuration(9, 0); !ok {
+		t.Fatalf("cannot drain refilled bucket")
+	}
+	if emptied != 2 {
+		t.Fatalf("after redraining: emptied %d times, want 2", emptied)
+	}
+}
+
+func TestPenalty(t *testing.T) {
+	mock := clock.NewMock()
+	penalty := NewLimiterWithClock(time.Hour, 3, mock)
+	l := NewLimiterWithClock(10*time.Millisecond, 1, mock, WithPenalty(penalty))
+
+	if n := l.TakeAvailable(1); n != 1 {
+		t.Fatalf("first take: got %d tokens, want 1", n)
+	}
+	for i := 0; i < 3; i++ {
+		if _, ok := l.TakeMaxDuration(1, 0); ok {
+			t.Fatalf("take %d on empty bucket succeeded", i)
+		}
+		if avail := penalty.Available(); avail != int64(2-i) {
+			t.Fatalf("after rejection %d: penalty available = %d, want %d", i, avail, 2-i)
+		}
+	}
+
+	mock.Add(10 * time.Millisecond)
+	if avail := l.Available(); avail != 1 {
+		t.Fatalf("after refill: available = %d, want 1", avail)
+	}
+	if n := l.TakeAvailable(1); n != 0 {
+		t.Fatalf("penalized take: got %d tokens, want 0", n)
+	}
+	if _, ok := l.TakeMaxDuration(1, time.Hour); ok {
+		t.Fatalf("penalized take with wait succeeded")
+	}
+	if d, trace := l.TakeTraced(1); d != 0 || trace.Refused != ErrPenalized {
+		t.Fatalf("penalized traced take: got %v, %+v; want ErrPenalized", d, trace)
+	}
+	if d, _ := l.ReserveInfo(1); d != 0 || l.Available() != 1 {
+		t.Fatalf("penalized reservation: wait %v, available %d; want 0 and 1", d, l.Available())
+	}
+
+	mock.Add(time.Hour)
+	if n := l.TakeAvailable(1); n != 1 {
+		t.Fatalf("after penalty refill: got %d tokens, want 1", n)
+	}
+}
+
+func TestReserveInfo(t *testing.T) {
+	l := NewLimiter(10*time.Millisecond, 10)
+	reqs := []struct {
+		count       int64
+		expectWait  time.Duration
+		expectAhead int64
+	}{
+		{count: 10, expectWait: 0, expectAhead: 0},
+		{count: 3, expectWait: 30 * time.Millisecond, expectAhead: 0},
+		{count: 2, expectWait: 50 * time.Millisecond, expectAhead: 3},
+		{count: 1, expectWait: 60 * time.Millisecond, expectAhead: 5},
+	}
+	for i, req := range reqs {
+		wait, ahead := l.reserveInfo(l.startTime, req.count)
+		if wait != req.expectWait || ahead != req.expectAhead {
+			t.Fatalf("#%d: got wait %v ahead %d, want wait %v ahead %d",
+				i, wait, ahead, req.expectWait, req.expectAhead)
+		}
+	}
+}
+
+func TestLastSpacing(t *testing.T) {
+	c := newFakeClock()
+	l := NewLimiterWithClock(10*time.Millisecond, 5, c)
+	if d := l.LastSpacing(); d != 0 {
+		t.Fatalf("before any take: last spacing = %v, want 0", d)
+	}
+	for i := 0; i < 20; i++ {
+		c.Sleep(3 * time.Millisecond)
+		l.Wait(1)
+	}
+	if d := l.LastSpacing(); d != 10*time.Millisecond {
+		t.Fatalf("steady consumer: last spacing = %v, want %v", d, 10*time.Millisecond)
+	}
+	if got, want := l.LastTake(), c.Now(); !got.Equal(want) {
+		t.Fatalf("last take = %v, want %v", got, want)
+	}
+}
+
+func TestTakeMoreThanCapacity(t *testing.T) {
+	l := NewLimiter(10*time.Millisecond, 10)
+	d, ok := l.take(l.startTime, 30, infinityDuration)
+	if !ok || d != 200*time.Millisecond {
+		t.Fatalf("take 3*capacity: got wait %v ok %v, want %v", d, ok, 200*time.Millisecond)
+	}
+	if avail := l.available(l.startTime.Add(190 * time.Millisecond)); avail != -1 {
+		t.Fatalf("before the wait: available = %d, want -1", avail)
+	}
+	if avail := l.available(l.startTime.Add(200 * time.Millisecond)); avail != 0 {
+		t.Fatalf("after the wait: available = %d, want 0", avail)
+	}
+	if avail := l.available(l.startTime.Add(time.Second)); avail != 10 {
+		t.Fatalf("long after the wait: available = %d, want 10", avail)
+	}
+}
+
+// expvarRuns counts the runs of TestPublishExpvar, so that each
+// publishes under a fresh name, as expvar names cannot be reused.
+var expvarRuns int32
+
+func TestPublishExpvar(t *testing.T) {
+	l := NewLimiter(100*time.Millisecond, 10)
+	l.TakeAvailable(4)
+	name := t.Name() + "." + strconv.Itoa(int(atomic.AddInt32(&expvarRuns, 1)))
+	PublishExpvar(name, l)
+
+	var got map[string]float64
+	if err := json.Unmarshal([]byte(expvar.Get(name).String()), &got); err != nil {
+		t.Fatalf("cannot decode published var: %v", err)
+	}
+	want := map[string]float64{"available": 6, "capacity": 10, "rate": 10}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("published var = %v, want %v", got, want)
+	}
+}
+
+func TestSetRate(t *testing.T) {
+	c := newFakeClock()
+	l := NewLimiterWithClock(100*time.Millisecond, 10, c)
+	l.Take(10)
+	c.Sleep(250 * time.Millisecond)
+	l.SetRate(100)
+	if r := l.Rate(); r != 100 {
+		t.Fatalf("rate = %v, want 100", r)
+	}
+	if avail := l.Available(); avail != 2 {
+		t.Fatalf("after rate change: available = %d, want 2", avail)
+	}
+	c.Sleep(50 * time.Millisecond)
+	if avail := l.Available(); avail != 7 {
+		t.Fatalf("after accrual at new rate: available = %d, want 7", avail)
+	}
+}
+
+func TestProbeRate(t *testing.T) {
+	const ceiling = 100
+	c := newFakeClock()
+	l := NewLimiterWithRateAndClock(10, 1, c)
+	var last time.Time
+	downstream := func() bool {
+		now := c.Now()
+		ok := last.IsZero() || now.Sub(last) >= time.Second/ceiling
+		last = now
+		return ok
+	}
+
+	rate, err := l.ProbeRate(context.Background(), 10, 10, downstream)
+	if err != nil {
+		t.Fatalf("probe failed: %v", err)
+	}
+	if rate != ceiling || l.Rate() != ceiling {
+		t.Fatalf("got probed rate %v, limiter rate %v, want %v", rate, l.Rate(), ceiling)
+	}
+
+	l = NewLimiterWithRateAndClock(10, 1, c)
+	last = time.Time{}
+	if _, err := l.ProbeRate(context.Background(), 200, 10, downstream); err != ErrProbeFailed {
+		t.Fatalf("probe above ceiling: got error %v, want %v", err, ErrProbeFailed)
+	}
+}
+
+func TestRateTicker(t *testing.T) {
+	c := newFakeClock()
+	l := NewLimiterWithClock(100*time.Millisecond, 1, c)
+	ticks, stop := NewRateTicker(l)
+
+	// checkSpacing skips the given number of ticks and then checks
+	// that the next few are spaced by want.
+	checkSpacing := func(skip int, want time.Duration) {
+		for i := 0; i < skip; i++ {
+			<-ticks
+		}
+		prev := <-ticks
+		for i := 0; i < 5; i++ {
+			tick := <-ticks
+			if d := tick.Sub(prev); d != want {
+				t.Fatalf("tick spacing = %v, want %v", d, want)
+			}
+			prev = tick
+		}
+	}
+	checkSpacing(1, 100*time.Millisecond)
+	l.SetRate(50)
+	checkSpacing(2, 20*time.Millisecond)
+
+	stop()
+	stop()
+	select {
+	case <-ticks:
+	case <-time.After(10 * time.Millisecond):
+	}
+	select {
+	case tick := <-ticks:
+		t.Fatalf("got tick %v after stop", tick)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// A paused limiter holds the ticker back until it is unpaused.
+	l = NewLimiterWithClock(100*time.Millisecond, 1, c)
+	l.Pause()
+	ticks, stop = NewRateTicker(l)
+	defer stop()
+	select {
+	case tick := <-ticks:
+		t.Fatalf("got tick %v while paused", tick)
+	case <-time.After(10 * time.Millisecond):
+	}
+	l.Unpause()
+	<-ticks
+}
+
+func TestRateTickerStop(t *testing.T) {
+	before := runtime.NumGoroutine()
+	l := NewLimiter(time.Hour, 1)
+	ticks, stop := NewRateTicker(l)
+	<-ticks
+
+	// The ticker is now waiting an hour for its next token.
+	stop()
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			t.Fatalf("ticker still running after stop: %d goroutines, want %d", runtime.NumGoroutine(), before)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestWaitContext(t *testing.T) {
+	c := newSleeperClock()
+	l := NewLimiterWithClock(time.Second, 1, c)
+	if err := l.WaitContext(context.Background(), 1); err != nil {
+		t.Fatalf("wait on full bucket: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error)
+	go func() {
+		errc <- l.WaitContext(ctx, 1)
+	}()
+	c.waitSleepers(t, 1)
+	cancel()
+	if err := <-errc; err != context.Canceled {
+		t.Fatalf("cancelled wait: got error %v, want %v", err, context.Canceled)
+	}
+
+	// The deadline is in system time, not on the limiter's clock.
+	// The cancelled wait took the only token due in the next second,
+	// so a wait now ends two seconds on.
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := l.WaitContext(ctx, 1); err != context.DeadlineExceeded {
+		t.Fatalf("wait beyond deadline: got error %v, want %v", err, context.DeadlineExceeded)
+	}
+	c.add(time.Second)
+	if avail := l.Available(); avail != 0 {
+		t.Fatalf("wait beyond deadline took tokens: available %d, want 0", avail)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), time.Hour)
+	defer cancel()
+	go func() {
+		errc <- l.WaitContext(ctx, 1)
+	}()
+	c.waitSleepers(t, 1)
+	c.add(time.Second)
+	if err := <-errc; err != nil {
+		t.Fatalf("wait within deadline: %v", err)
+	}
+
+	// A limiter clock ahead of the system clock does not put the
+	// deadline in the past.
+	f := newFakeClock()
+	f.Sleep(10 * 365 * 24 * time.Hour)
+	l = NewLimiterWithClock(time.Second, 1, f)
+	if err := l.WaitContext(ctx, 1); err != nil {
+		t.Fatalf("wait on full bucket with a clock ahead: %v", err)
+	}
+
+	// On the system clock, cancelling a wait ends it straight away.
+	l = NewLimiter(time.Hour, 1)
+	l.Take(1)
+	ctx, cancel = context.WithTimeout(context.Background(), 2*time.Hour)
+	defer cancel()
+	time.AfterFunc(10*time.Millisecond, cancel)
+	start := time.Now()
+	if err := l.WaitContext(ctx, 1); err != context.Canceled {
+		t.Fatalf("wait on system clock: got error %v, want %v", err, context.Canceled)
+	}
+	if d := time.Since(start); d > 10*time.Second {
+		t.Fatalf("wait on system clock returned after %v", d)
+	}
+}
+
+func TestWaitContextPenalized(t *testing.T) {
+	c := newFakeClock()
+	penalty := NewLimiterWithClock(time.Hour, 1, c)
+	var rejected int64
+	l := NewLimiterWithClock(time.Second, 1, c, WithPenalty(penalty), WithOnReject(func(count int64, tag string) {
+		rejected += count
+	}))
+	l.TakeAvailable(1)
+	if _, ok := l.TakeMaxDuration(1, 0); ok {
+		t.Fatalf("take on empty bucket succeeded")
+	}
+	c.Sleep(time.Second)
+	if err := l.WaitContext(context.Background(), 1); err != ErrPenalized {
+		t.Fatalf("penalized wait: got error %v, want %v", err, ErrPenalized)
+	}
+	if avail := l.Available(); avail != 1 {
+		t.Fatalf("penalized wait took tokens: available %d, want 1", avail)
+	}
+	if rejected != 2 || l.Stats().Rejected != 2 {
+		t.Fatalf("rejected %d tokens in %d takes, want 2 in 2", rejected, l.Stats().Rejected)
+	}
+}
+
+func TestPause(t *testing.T) {
+	c := newSleeperClock()
+	l := NewLimiterWithClock(time.Second, 1, c)
+	l.Take(1)
+
+	errc := make(chan error)
+	go func() {
+		errc <- l.WaitContext(context.Background(), 1)
+	}()
+	c.waitSleepers(t, 1)
+	l.Pause()
+	if err := <-errc; err != ErrPaused {
+		t.Fatalf("blocked wait: got error %v, want %v", err, ErrPaused)
+	}
+	if err := l.WaitContext(context.Background(), 1); err != ErrPaused {
+		t.Fatalf("wait while paused: got error %v, want %v", err, ErrPaused)
+	}
+
+	// Let the abandoned wait's sleep end, and drain the bucket.
+	l.Unpause()
+	c.add(2 * time.Second)
+	l.Take(1)
+	go func() {
+		errc <- l.WaitContext(context.Background(), 1)
+	}()
+	c.waitSleepers(t, 1)
+	c.add(time.Second)
+	if err := <-errc; err != nil {
+		t.Fatalf("wait after unpause: %v", err)
+	}
+}
+
+func TestStateBytes(t *testing.T) {
+	c := newFakeClock()
+	l := NewLimiterWithClock(10*time.Millisecond, 10, c)
+	l.TakeAvailable(7)
+	c.Sleep(25 * time.Millisecond)
+	state := l.StateBytes()
+
+	restored := NewLimiterWithQuantumAndClock(time.Second, 5, 100, c)
+	if err := restored.LoadStateBytes(state); err != nil {
+		t.Fatalf("cannot load state: %v", err)
+	}
+	if avail := restored.Available(); avail != 5 {
+		t.Fatalf("restored available = %d, want 5", avail)
+	}
+	if restored.Capacity() != 100 || restored.Rate() != 5 {
+		t.Fatalf("restored config changed: capacity %d, rate %v", restored.Capacity(), restored.Rate())
+	}
+
+	if err := l.LoadStateBytes(state[:stateLen-1]); err == nil {
+		t.Fatalf("loaded truncated state")
+	}
+	state[0] = stateVersion + 1
+	if err := l.LoadStateBytes(state); err == nil {
+		t.Fatalf("loaded state with unknown version")
+	}
+}
+
+func TestLoadStateBytesFromTheFuture(t *testing.T) {
+	ahead := newFakeClock()
+	ahead.Sleep(time.Hour)
+	saved := NewLimiterWithClock(time.Second, 10, ahead)
+	saved.TakeAvailable(5)
+	state := saved.StateBytes()
+
+	c := newFakeClock()
+	l := NewLimiterWithClock(time.Second, 10, c)
+	if err := l.LoadStateBytes(state); err != nil {
+		t.Fatalf("cannot load state: %v", err)
+	}
+	if avail := l.Available(); avail != 5 {
+		t.Fatalf("available %d after loading state saved an hour ahead, want 5", avail)
+	}
+	c.Sleep(2 * time.Second)
+	if avail := l.Available(); avail != 7 {
+		t.Fatalf("available %d 2s later, want 7", avail)
+	}
+}
+
+func TestFillSchedule(t *testing.T) {
+	l := NewLimiter(10*time.Millisecond, 10)
+	schedule := l.fillSchedule(l.startTime.Add(25*time.Millisecond), 4)
+	if len(schedule) != 4 {
+		t.Fatalf("got %d times, want 4", len(schedule))
+	}
+	for i, at := range schedule {
+		want := l.startTime.Add(time.Duration(30+10*i) * time.Millisecond)
+		if !at.Equal(want) {
+			t.Fatalf("time %d = %v, want %v", i, at.Sub(l.startTime), want.Sub(l.startTime))
+		}
+	}
+	if schedule := l.FillSchedule(0); schedule != nil {
+		t.Fatalf("got schedule %v for no times", schedule)
+	}
+}
+
+// steppingClock is a MonotonicClock whose wall clock can be
+// stepped independently of its monotonic reading.
+type steppingClock struct {
+	fakeClock
+	mono time.Duration
+}
+
+func (c *steppingClock) Sleep(d time.Duration) {
+	c.fakeClock.Sleep(d)
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.mono += d
+}
+
+func (c *steppingClock) Monotonic() time.Duration {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.mono
+}
+
+// step moves the wall clock by d.
+func (c *steppingClock) step(d time.Duration) {
+	c.fakeClock.Sleep(d)
+}
+
+func TestMonotonicClock(t *testing.T) {
+	c := &steppingClock{fakeClock: *newFakeClock()}
+	l := NewLimiterWithClock(10*time.Millisecond, 10, c, WithMonotonicClock())
+	wall := NewLimiterWithClock(10*time.Millisecond, 10, c)
+	l.Take(10)
+	wall.Take(10)
+
+	c.step(time.Hour)
+	if avail := l.Available(); avail != 0 {
+		t.Fatalf("after wall clock step: available = %d, want 0", avail)
+	}
+	if avail := wall.Available(); avail != 10 {
+		t.Fatalf("after wall clock step without monotonic clock: available = %d, want 10", avail)
+	}
+	c.Sleep(30 * time.Millisecond)
+	if avail := l.Available(); avail != 3 {
+		t.Fatalf("after time passes: available = %d, want 3", avail)
+	}
+	if avail := NewLimiter(time.Second, 5, WithMonotonicClock()).Available(); avail != 5 {
+		t.Fatalf("system clock: available = %d, want 5", avail)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatalf("no panic for clock without monotonic reading")
+		}
+	}()
+	NewLimiterWithClock(time.Second, 1, newFakeClock(), WithMonotonicClock())
+}
+
+func TestQuotaTracker(t *testing.T) {
+	c := newSleeperClock()
+	l := NewLimiterWithRateAndClock(100, 100, c)
+	q := NewQuotaTracker(l)
+
+	q.Observe(500, c.Now().Add(time.Second))
+	if r := l.Rate(); r != 100 {
+		t.Fatalf("with ample quota: rate = %v, want 100", r)
+	}
+
+	q.Observe(5, c.Now().Add(10*time.Second))
+	if r := l.Rate(); r != 0.5 {
+		t.Fatalf("with low quota: rate = %v, want 0.5", r)
+	}
+	if n := l.TakeAvailable(10); n != 5 {
+		t.Fatalf("with low quota: took %d tokens, want 5", n)
+	}
+	// The tracker waits for the reset.
+	c.waitSleepers(t, 1)
+	c.add(5 * time.Second)
+	// It sleeps again for the rest of the time until the reset.
+	c.waitSleepers(t, 1)
+	if n := l.TakeAvailable(10); n != 2 {
+		t.Fatalf("before reset: took %d tokens, want 2", n)
+	}
+
+	c.add(5 * time.Second)
+	for deadline := time.Now().Add(5 * time.Second); l.Rate() != 100; time.Sleep(100 * time.Microsecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("after reset: rate = %v, want 100", l.Rate())
+		}
+	}
+}
+
+func TestHasBlocked(t *testing.T) {
+	c := newFakeClock()
+	l := NewLimiterWithClock(10*time.Millisecond, 5, c)
+	for i := 0; i < 100; i++ {
+		l.Wait(1)
+		c.Sleep(20 * time.Millisecond)
+	}
+	if l.HasBlocked() {
+		t.Fatalf("under capacity: limiter has blocked")
+	}
+	l.Take(10)
+	if !l.HasBlocked() {
+		t.Fatalf("after blocking take: limiter has not blocked")
+	}
+}
+
+func TestDualBucket(t *testing.T) {
+	c := newFakeClock()
+	d := NewDualBucket(NewLimiterWithClock(time.Second, 10, c), NewLimiterWithClock(time.Second, 2, c))
+	if !d.AllowRead(8) {
+		t.Fatalf("cannot read within quota")
+	}
+	if !d.AllowWrite(2) {
+		t.Fatalf("cannot write within quota")
+	}
+	if d.AllowWrite(1) {
+		t.Fatalf("wrote beyond quota")
+	}
+	if !d.AllowRead(2) {
+		t.Fatalf("writes used up the read quota")
+	}
+
+	b, err := d.MarshalBinary()
+	if err != nil {
+		t.Fatalf("cannot marshal: %v", err)
+	}
+	restored := NewDualBucket(NewLimiterWithClock(time.Second, 10, c), NewLimiterWithClock(time.Second, 2, c))
+	restored.AllowRead(3)
+	if err := restored.UnmarshalBinary(b); err != nil {
+		t.Fatalf("cannot unmarshal: %v", err)
+	}
+	if r, w := restored.Read().Available(), restored.Write().Available(); r != 0 || w != 0 {
+		t.Fatalf("restored available = %d read, %d write, want 0 and 0", r, w)
+	}
+	if err := restored.UnmarshalBinary(b[:stateLen]); err == nil {
+		t.Fatalf("unmarshaled truncated state")
+	}
+
+	// A bad write half leaves the read half untouched too.
+	c.Sleep(time.Second)
+	bad := append([]byte(nil), b...)
+	bad[stateLen] = stateVersion + 1
+	if err := restored.UnmarshalBinary(bad); err == nil {
+		t.Fatalf("unmarshaled state with a bad write half")
+	}
+	if r := restored.Read().Available(); r != 1 {
+		t.Fatalf("after bad state: read available = %d, want 1", r)
+	}
+
+	s := d.Stats()
+	if s.Read.Takes != 2 || s.Read.Granted != 10 || s.Write.Takes != 1 || s.Write.Granted != 2 || s.Write.Rejected != 1 {
+		t.Fatalf("stats = %+v", s)
+	}
+}
+
+func TestCostTable(t *testing.T) {
+	c := newFakeClock()
+	l := NewLimiterWithClock(time.Second, 10, c, WithCostTable(map[string]int64{
+		"cheap":     1,
+		"expensive": 7,
+	}))
+	if ok, err := l.AllowOp("expensive"); !ok || err != nil {
+		t.Fatalf("expensive op: got %v, %v, want true, nil", ok, err)
+	}
+	if avail := l.Available(); avail != 3 {
+		t.Fatalf("after expensive op: available = %d, want 3", avail)
+	}
+	if ok, err := l.AllowOp("expensive"); ok || err != nil {
+		t.Fatalf("expensive op beyond available: got %v, %v, want false, nil", ok, err)
+	}
+	if err := l.WaitOp("cheap"); err != nil {
+		t.Fatalf("cheap op: %v", err)
+	}
+	if avail := l.Available(); avail != 2 {
+		t.Fatalf("after cheap op: available = %d, want 2", avail)
+	}
+	if _, err := l.AllowOp("unknown"); !errors.Is(err, ErrUnknownOp) {
+		t.Fatalf("unknown op: got error %v, want %v", err, ErrUnknownOp)
+	}
+	if err := l.WaitOp("unknown"); !errors.Is(err, ErrUnknownOp) {
+		t.Fatalf("unknown op: got error %v, want %v", err, ErrUnknownOp)
+	}
+}
+
+func TestTimeToFull(t *testing.T) {
+	c := newFakeClock()
+	l := NewLimiterWithClock(10*time.Millisecond, 10, c)
+	if d := l.TimeToFull(); d != 0 {
+		t.Fatalf("full bucket: time to full = %v, want 0", d)
+	}
+	l.Take(12)
+	c.Sleep(5 * time.Millisecond)
+	if d := l.TimeToFull(); d != 115*time.Millisecond {
+		t.Fatalf("drained bucket: time to full = %v, want %v", d, 115*time.Millisecond)
+	}
+}
+
+// sleepRecorder is a fakeClock that records the durations it is
+// asked to sleep for.
+type sleepRecorder struct {
+	fakeClock
+	slept []time.Duration
+}
+
+func (c *sleepRecorder) Sleep(d time.Duration) {
+	c.slept = append(c.slept, d)
+	c.fakeClock.Sleep(d)
+}
+
+func TestTimerResolution(t *testing.T) {
+	c := &sleepRecorder{fakeClock: *newFakeClock()}
+	l := NewLimiterWithClock(10*time.Millisecond, 1, c, WithTimerResolution(15*time.Millisecond))
+	l.Wait(1)
+	l.Wait(1)
+	l.Wait(3)
+	want := []time.Duration{15 * time.Millisecond, 30 * time.Millisecond}
+	if !reflect.DeepEqual(c.slept, want) {
+		t.Fatalf("slept for %v, want %v", c.slept, want)
+	}
+	if avail := l.Available(); avail != 0 {
+		t.Fatalf("available = %d, want 0", avail)
+	}
+	c.Sleep(5 * time.Millisecond)
+	if avail := l.Available(); avail != 1 {
+		t.Fatalf("after next tick: available = %d, want 1", avail)
+	}
+}
+
+func TestTakeIfQueueBelow(t *testing.T) {
+	l := NewLimiter(10*time.Millisecond, 5)
+	reqs := []struct {
+		count      int64
+		expectWait time.Duration
+		expectOK   bool
+	}{
+		{count: 5, expectWait: 0, expectOK: true},
+		{count: 2, expectWait: 20 * time.Millisecond, expectOK: true},
+		{count: 1, expectWait: 30 * time.Millisecond, expectOK: true},
+		{count: 1, expectWait: 0, expectOK: false},
+	}
+	for i, req := range reqs {
+		d, ok := l.takeIfQueueBelow(l.startTime, req.count, 3)
+		if d != req.expectWait || ok != req.expectOK {
+			t.Fatalf("#%d: got %v, %v, want %v, %v", i, d, ok, req.expectWait, req.expectOK)
+		}
+	}
+	if d, ok := l.takeIfQueueBelow(l.startTime.Add(10*time.Millisecond), 1, 3); !ok || d != 30*time.Millisecond {
+		t.Fatalf("after queue shrinks: got %v, %v, want %v, true", d, ok, 30*time.Millisecond)
+	}
+}
+
+func TestTakeHistogram(t *testing.T) {
+	c := newFakeClock()
+	l := NewLimiterWithClock(time.Millisecond, 100, c, WithTakeHistory(1000))
+	for i := 0; i < 100; i++ {
+		c.Sleep(10 * time.Millisecond)
+		l.TakeAvailable(1)
+	}
+	want := []int64{10, 10, 10, 10, 10}
+	if got := l.TakeHistogram(100*time.Millisecond, 5); !reflect.DeepEqual(got, want) {
+		t.Fatalf("steady consumer: histogram = %v, want %v", got, want)
+	}
+
+	for i := 0; i < 5; i++ {
+		c.Sleep(100 * time.Millisecond)
+		if i%2 == 0 {
+			l.TakeAvailable(30)
+		}
+	}
+	want = []int64{30, 0, 30, 0, 30}
+	if got := l.TakeHistogram(100*time.Millisecond, 5); !reflect.DeepEqual(got, want) {
+		t.Fatalf("bursty consumer: histogram = %v, want %v", got, want)
+	}
+
+	if got := NewLimiter(time.Second, 1).TakeHistogram(time.Second, 1); got != nil {
+		t.Fatalf("without history: histogram = %v, want nil", got)
+	}
+}
+
+func TestTakeTraced(t *testing.T) {
+	l := NewLimiter(10*time.Millisecond, 4)
+	l.take(l.startTime, 7, infinityDuration)
+	now := l.startTime.Add(5 * time.Millisecond)
+	d, trace := l.takeTraced(now, 2)
+	want := TakeTrace{
+		Time:      now,
+		Available: -3,
+		Reserved:  2,
+		Ahead:     3,
+		Wait:      45 * time.Millisecond,
+	}
+	if d != want.Wait || trace != want {
+		t.Fatalf("got wait %v, trace %+v, want %+v", d, trace, want)
+	}
+	if avail := l.available(now); avail != -5 {
+		t.Fatalf("after traced take: available = %d, want -5", avail)
+	}
+}
+
+func TestSetCapacity(t *testing.T) {
+	l := NewLimiter(10*time.Millisecond, 10)
+	l.take(l.startTime, 10, infinityDuration)
+	if d, _ := l.take(l.startTime, 5, infinityDuration); d != 50*time.Millisecond {
+		t.Fatalf("reservation: got wait %v, want %v", d, 50*time.Millisecond)
+	}
+	l.setCapacity(l.startTime.Add(time.Millisecond), 2)
+	if avail := l.available(l.startTime.Add(40 * time.Millisecond)); avail != -1 {
+		t.Fatalf("before reservation is due: available = %d, want -1", avail)
+	}
+	if avail := l.available(l.startTime.Add(50 * time.Millisecond)); avail != 0 {
+		t.Fatalf("when reservation is due: available = %d, want 0", avail)
+	}
+	if avail := l.available(l.startTime.Add(time.Second)); avail != 2 {
+		t.Fatalf("after refill: available = %d, want 2", avail)
+	}
+	l.setCapacity(l.startTime.Add(time.Second), 1)
+	if avail := l.available(l.startTime.Add(time.Second)); avail != 1 {
+		t.Fatalf("after shrinking full bucket: available = %d, want 1", avail)
+	}
+}
+
+func TestSetPressure(t *testing.T) {
+	l := NewLimiterWithRate(50, 10, WithPressureRange(10, 110))
+	for _, test := range []struct {
+		pressure float64
+		rate     float64
+	}{
+		{pressure: 0, rate: 10},
+		{pressure: 1, rate: 110},
+		{pressure: 0.5, rate: 60},
+		{pressure: -1, rate: 10},
+		{pressure: 2, rate: 110},
+	} {
+		l.SetPressure(test.pressure)
+		if r := l.Rate(); !isCloseTo(r, test.rate, RateMargin) {
+			t.Fatalf("pressure %v: rate = %v, want %v", test.pressure, r, test.rate)
+		}
+	}
+}
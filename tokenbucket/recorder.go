@@ -0,0 +1,111 @@
+package tokenbucket
+
+import "time"
+
+// maxTakeRecords holds the number of takes a limiter created with
+// WithRecorder remembers.
+const maxTakeRecords = 4096
+
+// TakeRecord describes a single take from a Limiter, as recorded
+// by WithRecorder.
+type TakeRecord struct {
+	// Time holds the time of the take.
+	Time time.Time
+	// Count holds the number of tokens requested.
+	Count int64
+	// MaxWait holds the longest wait the take accepted.
+	MaxWait time.Duration
+	// UpTo records whether the take accepted fewer tokens
+	// than requested, as TakeAvailable does.
+	UpTo bool
+	// Granted holds the number of tokens granted, which is
+	// zero if the take was rejected.
+	Granted int64
+	// Wait holds how long the caller had to wait for the
+	// granted tokens.
+	Wait time.Duration
+	// Tag holds the tag given to AllowTagged, if any.
+	Tag string
+}
+
+// takeRecorder is a ring buffer holding the most recent takes.
+type takeRecorder struct {
+	records []TakeRecord
+	// next holds the index the next record is stored at.
+	next int
+	full bool
+}
+
+// add records r, replacing the oldest record if the buffer is full.
+func (rec *takeRecorder) add(r TakeRecord) {
+	if rec.records == nil {
+		rec.records = make([]TakeRecord, maxTakeRecords)
+	}
+	rec.records[rec.next] = r
+	rec.next++
+	if rec.next == len(rec.records) {
+		rec.next = 0
+		rec.full = true
+	}
+}
+
+// record records a take for ExportHistory and GrantedSizeHistogram,
+// if enabled. l.mtx must be held.
+func (l *Limiter) record(r TakeRecord) {
+	r.Tag = l.tag
+	if l.recorder != nil {
+		l.recorder.add(r)
+	}
+	if l.sizes != nil && r.Count > 0 {
+		l.sizes.add(r.Count, r.Granted)
+	}
+}
+
+// ExportHistory returns the takes the limiter has recorded, oldest
+// first, if it was created with WithRecorder, or nil otherwise.
+// Takes rejected without consulting the bucket, because of a
+// penalty or by TakeIfQueueBelow, and takes made by
+// KeyedLimiter.AllowBatch in all-or-nothing mode are not recorded.
+func (l *Limiter) ExportHistory() []TakeRecord {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	rec := l.recorder
+	if rec == nil {
+		return nil
+	}
+	if !rec.full {
+		return append([]TakeRecord(nil), rec.records[:rec.next]...)
+	}
+	history := make([]TakeRecord, 0, len(rec.records))
+	history = append(history, rec.records[rec.next:]...)
+	return append(history, rec.records[:rec.next]...)
+}
+
+// Replay makes the takes in history, as returned by ExportHistory,
+// at their recorded times, and returns records of the outcomes.
+// Replaying a complete history through a fresh limiter with the
+// same configuration and start time reproduces the original
+// decisions. The limiter's clock is not consulted, so the history
+// must not go back before the limiter's last take.
+func (l *Limiter) Replay(history []TakeRecord) []TakeRecord {
+	l.mtx.Lock()
+	defer l.unlock()
+	results := make([]TakeRecord, len(history))
+	for i, r := range history {
+		l.tag = r.Tag
+		if r.UpTo {
+			r.Granted = l.takeAvailable(r.Time, r.Count)
+			r.Wait = 0
+		} else {
+			var ok bool
+			r.Wait, ok = l.take(r.Time, r.Count, r.MaxWait)
+			r.Granted = 0
+			if ok {
+				r.Granted = r.Count
+			}
+		}
+		results[i] = r
+	}
+	l.tag = ""
+	return results
+}
@@ -0,0 +1,20 @@
+//go:build go1.23
+
+package tokenbucket
+
+import "iter"
+
+// RateLimitSeq returns a sequence that yields the items of seq,
+// waiting for a token from l before yielding each one. Items are
+// only drawn from seq as they are yielded, so if the consumer stops
+// early no further tokens are taken.
+func RateLimitSeq[T any](seq iter.Seq[T], l *Limiter) iter.Seq[T] {
+	return func(yield func(T) bool) {
+		for item := range seq {
+			l.Wait(1)
+			if !yield(item) {
+				return
+			}
+		}
+	}
+}
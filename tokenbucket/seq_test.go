@@ -0,0 +1,49 @@
+//go:build go1.23
+
+package tokenbucket
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestRateLimitSeq(t *testing.T) {
+	c := newFakeClock()
+	l := NewLimiterWithClock(10*time.Millisecond, 1, c)
+	start := c.Now()
+
+	var got []time.Duration
+	for i := range RateLimitSeq(slices.Values([]int{0, 1, 2, 3}), l) {
+		if i != len(got) {
+			t.Fatalf("got item %d, want %d", i, len(got))
+		}
+		got = append(got, c.Now().Sub(start))
+	}
+	want := []time.Duration{0, 10 * time.Millisecond, 20 * time.Millisecond, 30 * time.Millisecond}
+	if !slices.Equal(got, want) {
+		t.Fatalf("items yielded at %v, want %v", got, want)
+	}
+
+	l = NewLimiterWithClock(10*time.Millisecond, 5, c)
+	drawn := 0
+	source := func(yield func(int) bool) {
+		for i := 0; ; i++ {
+			drawn++
+			if !yield(i) {
+				return
+			}
+		}
+	}
+	for i := range RateLimitSeq(source, l) {
+		if i == 2 {
+			break
+		}
+	}
+	if drawn != 3 {
+		t.Fatalf("drew %d items after break, want 3", drawn)
+	}
+	if avail := l.Available(); avail != 2 {
+		t.Fatalf("available = %d after break, want 2", avail)
+	}
+}
@@ -0,0 +1,50 @@
+package tokenbucket
+
+// SizeCount holds counts of the takes requesting a given number of
+// tokens, as returned by GrantedSizeHistogram.
+type SizeCount struct {
+	// Requested holds the number of takes of the size.
+	Requested int64
+	// Full holds the number of them granted all the tokens
+	// requested.
+	Full int64
+	// Partial holds the number of them granted only some of
+	// the tokens requested, as TakeAvailable may be.
+	Partial int64
+}
+
+// sizeHistogram counts takes by the number of tokens requested.
+type sizeHistogram map[int64]SizeCount
+
+// add counts a take of count tokens that was granted the given
+// number of them.
+func (h sizeHistogram) add(count, granted int64) {
+	c := h[count]
+	c.Requested++
+	switch {
+	case granted >= count:
+		c.Full++
+	case granted > 0:
+		c.Partial++
+	}
+	h[count] = c
+}
+
+// GrantedSizeHistogram returns, for each number of tokens requested
+// by a take from the limiter, how many takes requested it and how
+// many of those were granted all or some of the tokens. The
+// difference is the number rejected outright. Only takes that
+// consult the bucket are counted, as for ExportHistory. It returns
+// nil unless the limiter was created with WithGrantedSizeHistogram.
+func (l *Limiter) GrantedSizeHistogram() map[int64]SizeCount {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if l.sizes == nil {
+		return nil
+	}
+	h := make(map[int64]SizeCount, len(l.sizes))
+	for size, c := range l.sizes {
+		h[size] = c
+	}
+	return h
+}
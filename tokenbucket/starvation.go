@@ -0,0 +1,96 @@
+package tokenbucket
+
+import "time"
+
+// maxEmptySpans holds the maximum number of empty periods a
+// Limiter remembers for StarvationRatio.
+const maxEmptySpans = 64
+
+// timeSpan represents the half-open period [start, end).
+type timeSpan struct {
+	start, end time.Time
+}
+
+// overlap returns how much of s lies within [from, to).
+func (s timeSpan) overlap(from, to time.Time) time.Duration {
+	if s.start.After(from) {
+		from = s.start
+	}
+	if s.end.Before(to) {
+		to = s.end
+	}
+	if !to.After(from) {
+		return 0
+	}
+	return to.Sub(from)
+}
+
+// tickTime returns the moment at which the given tick starts.
+func (l *Limiter) tickTime(tick int64) time.Time {
+	return l.startTime.Add(time.Duration(tick) * l.fillInterval)
+}
+
+// emptySpan returns the period, starting at the given tick, during
+// which the bucket stays empty if no more tokens are taken. The
+// bucket must be empty.
+func (l *Limiter) emptySpan(tick int64) timeSpan {
+	emptyTicks := -l.availableTokens/l.quantum + 1
+	return timeSpan{
+		start: l.tickTime(tick),
+		end:   l.tickTime(tick + emptyTicks),
+	}
+}
+
+// recordEmpty records that the bucket, which is empty as of
+// lastTick, has been refilled up to tick. Since no tokens are
+// taken between refills, the period the bucket stayed empty
+// for can be worked out exactly.
+func (l *Limiter) recordEmpty(lastTick, tick int64) {
+	span := l.emptySpan(lastTick)
+	if end := l.tickTime(tick); span.end.After(end) {
+		span.end = end
+	}
+	if !span.end.After(span.start) {
+		return
+	}
+
+	if n := len(l.emptySpans); n > 0 && !l.emptySpans[n-1].end.Before(span.start) {
+		l.emptySpans[n-1].end = span.end
+		return
+	}
+	if len(l.emptySpans) == maxEmptySpans {
+		copy(l.emptySpans, l.emptySpans[1:])
+		l.emptySpans = l.emptySpans[:maxEmptySpans-1]
+	}
+	l.emptySpans = append(l.emptySpans, span)
+}
+
+// StarvationRatio returns the fraction of the trailing window
+// during which the bucket had no tokens available, in the range
+// [0, 1]. Emptiness is sampled whenever tokens are added to the
+// bucket, so it is measured in whole fill intervals, and only the
+// most recent periods of emptiness are remembered.
+func (l *Limiter) StarvationRatio(window time.Duration) float64 {
+	if window <= 0 {
+		return 0
+	}
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	now := l.now()
+	from := now.Add(-window)
+
+	var starved time.Duration
+	for _, span := range l.emptySpans {
+		starved += span.overlap(from, now)
+	}
+	if l.availableTokens <= 0 {
+		// The bucket may have stayed empty since it was last
+		// refilled; account for that without changing its state.
+		span := l.emptySpan(l.latestTick)
+		if n := len(l.emptySpans); n > 0 && l.emptySpans[n-1].end.After(span.start) {
+			span.start = l.emptySpans[n-1].end
+		}
+		starved += span.overlap(from, now)
+	}
+	return float64(starved) / float64(window)
+}
@@ -0,0 +1,70 @@
+package tokenbucket
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// stateVersion holds the version of the encoding produced by
+// StateBytes.
+const stateVersion = 1
+
+// stateLen holds the length of the encoding produced by StateBytes:
+// a version byte followed by the available tokens and the reference
+// time in Unix nanoseconds.
+const stateLen = 1 + 8 + 8
+
+// StateBytes returns the dynamic state of the bucket - the number
+// of available tokens and the time they were last worked out at -
+// without its configuration, for compact checkpoints. The state can
+// be restored with LoadStateBytes on a limiter configured the same
+// way.
+func (l *Limiter) StateBytes() []byte {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	l.adjustAvailableTokens(l.currentTick(l.now()))
+	b := make([]byte, stateLen)
+	b[0] = stateVersion
+	binary.BigEndian.PutUint64(b[1:], uint64(l.availableTokens))
+	binary.BigEndian.PutUint64(b[9:], uint64(l.tickTime(l.latestTick).UnixNano()))
+	return b
+}
+
+// LoadStateBytes replaces the dynamic state of the bucket with one
+// returned by StateBytes, leaving its configuration untouched. Tokens
+// accrue from the time recorded in the state, or from now if that
+// time is in the future, and available tokens beyond the capacity of
+// the bucket are dropped.
+func (l *Limiter) LoadStateBytes(b []byte) error {
+	if err := checkStateBytes(b); err != nil {
+		return err
+	}
+	available := int64(binary.BigEndian.Uint64(b[1:]))
+	ref := time.Unix(0, int64(binary.BigEndian.Uint64(b[9:])))
+	if now := l.now(); ref.After(now) {
+		// The state was saved by a clock ahead of ours.
+		ref = now
+	}
+
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if max := l.accrualCap(); available > max {
+		available = max
+	}
+	l.availableTokens = available
+	l.latestTick = l.currentTick(ref)
+	return nil
+}
+
+// checkStateBytes reports whether b could have been returned by
+// StateBytes.
+func checkStateBytes(b []byte) error {
+	if len(b) != stateLen {
+		return fmt.Errorf("tokenbucket: state is %d bytes long, want %d", len(b), stateLen)
+	}
+	if b[0] != stateVersion {
+		return fmt.Errorf("tokenbucket: unsupported state version %d", b[0])
+	}
+	return nil
+}
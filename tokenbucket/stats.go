@@ -0,0 +1,53 @@
+package tokenbucket
+
+import "time"
+
+// Stats holds counters of the activity of a Limiter since it was
+// created.
+type Stats struct {
+	// Takes holds the number of takes that were granted tokens.
+	Takes int64
+	// Granted holds the total number of tokens granted.
+	Granted int64
+	// Rejected holds the number of takes that were refused
+	// tokens, including those refused because of a penalty.
+	Rejected int64
+	// Waited holds the number of granted takes that had to
+	// wait for their tokens.
+	Waited int64
+	// WaitTime holds the total time granted takes had to wait.
+	WaitTime time.Duration
+}
+
+// Stats returns the limiter's activity counters.
+func (l *Limiter) Stats() Stats {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	return l.stats
+}
+
+// StatsDelta returns the activity since prev, an earlier result of
+// Stats, as the difference of each counter. It saves callers that
+// want rates from keeping track of the counters themselves.
+func (l *Limiter) StatsDelta(prev Stats) Stats {
+	s := l.Stats()
+	return Stats{
+		Takes:    s.Takes - prev.Takes,
+		Granted:  s.Granted - prev.Granted,
+		Rejected: s.Rejected - prev.Rejected,
+		Waited:   s.Waited - prev.Waited,
+		WaitTime: s.WaitTime - prev.WaitTime,
+	}
+}
+
+// WastedTokens returns the number of tokens that would have been
+// added to the bucket over its life but for it being full at the
+// time. A high count relative to Stats().Granted suggests the rate
+// is higher, or the capacity larger, than the demand needs.
+func (l *Limiter) WastedTokens() int64 {
+	now := l.now()
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	l.adjustAvailableTokens(l.currentTick(now))
+	return l.wasted
+}
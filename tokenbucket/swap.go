@@ -0,0 +1,79 @@
+package tokenbucket
+
+import "time"
+
+// bucketState holds the parameters and state of a bucket, as copied
+// by Swap.
+type bucketState struct {
+	capacity        int64
+	startTime       time.Time
+	fillInterval    time.Duration
+	quantum         int64
+	requestedRate   float64
+	availableTokens int64
+	latestTick      int64
+	creditSpent     bool
+	nextGrant       time.Time
+	emptySpans      []timeSpan
+	wasted          int64
+}
+
+// Swap makes l adopt the fill interval, quantum and capacity of
+// other, and the tokens it has available or reserved, so that
+// everything holding l carries on with the new parameters, as in a
+// blue/green switch to a prepared limiter. The rest of the state of
+// other's bucket comes with them: whether it has spent its banked
+// credit, when its next paced token is due, when it was last empty
+// and how many tokens it has wasted. other is copied as of a single
+// instant and l is changed as of a single instant; other is not
+// changed. The two limiters should share a clock.
+//
+// Options given to l when it was created, such as callbacks, stay
+// in force, and any ramp started by RampRate ends. In particular, a
+// rate below the one given by WithMinGrantRate is raised to it.
+// Callers already waiting on l for reserved tokens are not
+// affected, while later takes queue behind the reservations made on
+// other.
+func (l *Limiter) Swap(other *Limiter) {
+	if l == other {
+		return
+	}
+	other.mtx.Lock()
+	// Bring other up to date first, so that the tokens it has
+	// wasted are counted against its own capacity.
+	other.adjustAvailableTokens(other.currentTick(other.now()))
+	s := bucketState{
+		capacity:        other.capacity,
+		startTime:       other.startTime,
+		fillInterval:    other.fillInterval,
+		quantum:         other.quantum,
+		requestedRate:   other.requestedRate,
+		availableTokens: other.availableTokens,
+		latestTick:      other.latestTick,
+		creditSpent:     other.creditSpent,
+		nextGrant:       other.nextGrant,
+		emptySpans:      append([]timeSpan(nil), other.emptySpans...),
+		wasted:          other.wasted,
+	}
+	other.mtx.Unlock()
+
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	l.capacity = s.capacity
+	l.startTime = s.startTime
+	l.fillInterval = s.fillInterval
+	l.quantum = s.quantum
+	l.requestedRate = s.requestedRate
+	l.availableTokens = s.availableTokens
+	l.latestTick = s.latestTick
+	l.creditSpent = s.creditSpent
+	l.nextGrant = s.nextGrant
+	l.emptySpans = s.emptySpans
+	l.wasted = s.wasted
+	l.rampGen++
+	if rate := fillRate(l.fillInterval, l.quantum); l.grantRate(rate) != rate {
+		fillInterval, quantum := rateQuantum(l.minGrantRate)
+		l.setFill(l.now(), fillInterval, quantum)
+		l.requestedRate = l.minGrantRate
+	}
+}
@@ -0,0 +1,23 @@
+package tokenbucket
+
+// AllowTagged takes count tokens from the bucket if they are
+// available immediately, and reports whether it did. The tag is
+// passed to the function given by WithOnReject if the take is
+// rejected, and is kept in the take's record if the limiter was
+// created with WithRecorder, so that decisions can be correlated
+// with the requests that caused them.
+func (l *Limiter) AllowTagged(count int64, tag string) bool {
+	floored, err := l.refusal(count, tag)
+	if err != nil {
+		return false
+	}
+	l.mtx.Lock()
+	defer l.unlock()
+	l.tag = tag
+	_, ok := l.take(l.now(), count, 0)
+	l.tag = ""
+	if ok && floored {
+		l.chargeFloor(count)
+	}
+	return ok
+}
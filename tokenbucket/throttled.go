@@ -0,0 +1,232 @@
+package tokenbucket
+
+import (
+	"container/heap"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// sketchDepth and sketchWidth hold the dimensions of the
+	// count-min sketches used to count rejections per key.
+	sketchDepth = 4
+	sketchWidth = 2048
+
+	// maxThrottledKeys holds the number of most rejected keys
+	// tracked for TopThrottled.
+	maxThrottledKeys = 100
+)
+
+// KeyCount holds a key and the number of times it was counted.
+type KeyCount struct {
+	Key   string
+	Count int64
+}
+
+// countMinSketch approximately counts occurrences of keys in
+// constant memory. Estimates may exceed, but never fall short of,
+// the true counts.
+type countMinSketch [sketchDepth][sketchWidth]uint32
+
+// fnv64a returns the 64-bit FNV-1a hash of key.
+func fnv64a(key string) uint64 {
+	const (
+		offset64 = 14695981039346656037
+		prime64  = 1099511628211
+	)
+	h := uint64(offset64)
+	for i := 0; i < len(key); i++ {
+		h ^= uint64(key[i])
+		h *= prime64
+	}
+	return h
+}
+
+// indexes returns the counter each row of the sketch uses for the
+// key with the given hash.
+func (s *countMinSketch) indexes(h uint64) (idx [sketchDepth]uint32) {
+	h1, h2 := uint32(h), uint32(h>>32)|1
+	for i := range idx {
+		idx[i] = (h1 + uint32(i)*h2) % sketchWidth
+	}
+	return idx
+}
+
+// add counts one more occurrence of the key with the given hash.
+func (s *countMinSketch) add(h uint64) {
+	for i, j := range s.indexes(h) {
+		s[i][j]++
+	}
+}
+
+// estimate returns the estimated count of the key with the given
+// hash.
+func (s *countMinSketch) estimate(h uint64) int64 {
+	min := uint32(1<<32 - 1)
+	for i, j := range s.indexes(h) {
+		if s[i][j] < min {
+			min = s[i][j]
+		}
+	}
+	return int64(min)
+}
+
+// throttleCandidate is a key tracked as one of the most rejected.
+type throttleCandidate struct {
+	KeyCount
+	hash  uint64
+	index int
+}
+
+// candidateHeap is a min-heap of candidates ordered by count.
+type candidateHeap []*throttleCandidate
+
+func (h candidateHeap) Len() int           { return len(h) }
+func (h candidateHeap) Less(i, j int) bool { return h[i].Count < h[j].Count }
+func (h candidateHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *candidateHeap) Push(x interface{}) {
+	c := x.(*throttleCandidate)
+	c.index = len(*h)
+	*h = append(*h, c)
+}
+
+func (h *candidateHeap) Pop() interface{} {
+	old := *h
+	c := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return c
+}
+
+// throttleTracker approximately tracks the keys rejected most often
+// over a recent window. Rejections are counted in two sketches, for
+// the current and the previous window, so that counts cover between
+// one and two windows.
+type throttleTracker struct {
+	clock  Clock
+	window time.Duration
+
+	// mtx guards the fields below it.
+	mtx        sync.Mutex
+	epoch      time.Time
+	cur, prev  *countMinSketch
+	candidates map[string]*throttleCandidate
+	heap       candidateHeap
+}
+
+func newThrottleTracker(window time.Duration, clock Clock) *throttleTracker {
+	if window <= 0 {
+		panic("throttle tracking window is not > 0")
+	}
+	if clock == nil {
+		clock = realClock{}
+	}
+	return &throttleTracker{
+		clock:      clock,
+		window:     window,
+		epoch:      clock.Now(),
+		cur:        new(countMinSketch),
+		prev:       new(countMinSketch),
+		candidates: make(map[string]*throttleCandidate),
+	}
+}
+
+// rotate starts new windows for the time that has passed since the
+// current one started, re-estimating the candidates if it does.
+func (t *throttleTracker) rotate(now time.Time) {
+	n := now.Sub(t.epoch) / t.window
+	if n <= 0 {
+		return
+	}
+	t.epoch = t.epoch.Add(n * t.window)
+	if n == 1 {
+		t.prev, t.cur = t.cur, t.prev
+		*t.cur = countMinSketch{}
+	} else {
+		*t.cur, *t.prev = countMinSketch{}, countMinSketch{}
+	}
+
+	live := t.heap[:0]
+	for _, c := range t.heap {
+		c.Count = t.cur.estimate(c.hash) + t.prev.estimate(c.hash)
+		if c.Count == 0 {
+			delete(t.candidates, c.Key)
+			continue
+		}
+		live = append(live, c)
+	}
+	for i := len(live); i < len(t.heap); i++ {
+		t.heap[i] = nil
+	}
+	t.heap = live
+	for i, c := range t.heap {
+		c.index = i
+	}
+	heap.Init(&t.heap)
+}
+
+// record counts a rejection of key.
+func (t *throttleTracker) record(key string) {
+	h := fnv64a(key)
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	t.rotate(t.clock.Now())
+	t.cur.add(h)
+	count := t.cur.estimate(h) + t.prev.estimate(h)
+
+	if c, ok := t.candidates[key]; ok {
+		c.Count = count
+		heap.Fix(&t.heap, c.index)
+		return
+	}
+	if len(t.heap) < maxThrottledKeys {
+		c := &throttleCandidate{KeyCount: KeyCount{key, count}, hash: h}
+		t.candidates[key] = c
+		heap.Push(&t.heap, c)
+		return
+	}
+	if min := t.heap[0]; count > min.Count {
+		delete(t.candidates, min.Key)
+		min.KeyCount = KeyCount{key, count}
+		min.hash = h
+		t.candidates[key] = min
+		heap.Fix(&t.heap, 0)
+	}
+}
+
+// top returns up to k of the most rejected keys, most rejected
+// first.
+func (t *throttleTracker) top(k int) []KeyCount {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	t.rotate(t.clock.Now())
+	top := make([]KeyCount, len(t.heap))
+	for i, c := range t.heap {
+		top[i] = c.KeyCount
+	}
+	sort.Slice(top, func(i, j int) bool {
+		return top[i].Count > top[j].Count
+	})
+	if k < len(top) {
+		top = top[:k]
+	}
+	return top
+}
+
+// TopThrottled returns up to n of the keys rejected most often by
+// Allow over the recent window, most rejected first, with their
+// approximate rejection counts. Only keys among the 100 most
+// rejected are tracked, and counts may be overestimated, so the
+// result is approximate. It returns nil unless the keyed limiter
+// was created with WithThrottleTracking, or if n is not positive.
+func (k *KeyedLimiter) TopThrottled(n int) []KeyCount {
+	if k.throttled == nil || n <= 0 {
+		return nil
+	}
+	return k.throttled.top(n)
+}
@@ -0,0 +1,53 @@
+package tokenbucket
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// NewRateTicker returns a channel that delivers the time each time a
+// token is taken from l, like the channel of a time.Ticker whose
+// period follows the rate of the limiter, including changes made
+// with SetRate. Other takes from l slow the ticker down accordingly.
+//
+// Ticks are not buffered: a token is only taken for the next tick
+// once the previous one has been received. Calling stop stops the
+// ticker, ending any wait for the next token; as with time.Ticker,
+// the channel is not closed. A tick whose token was taken before
+// stop is called may still be delivered, but no further tokens are
+// taken.
+//
+// The ticker waits with WaitContext, so it is subject to
+// WithAdmissionFilter, WithPenalty, WithLifetimeQuota and Pause. A
+// wait refused by any of them is retried one fill interval later.
+func NewRateTicker(l *Limiter) (ticks <-chan time.Time, stop func()) {
+	ch := make(chan time.Time)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		for {
+			if err := l.WaitContext(ctx, 1); err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				l.mtx.Lock()
+				d := l.fillInterval
+				l.mtx.Unlock()
+				if l.sleepContext(ctx, nil, d) != nil {
+					return
+				}
+				continue
+			}
+			select {
+			case ch <- l.now():
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(cancel)
+	}
+}
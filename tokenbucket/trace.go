@@ -0,0 +1,82 @@
+package tokenbucket
+
+import "time"
+
+// TakeTrace describes how the wait of a take was worked out.
+type TakeTrace struct {
+	// Time holds the time the take was made at.
+	Time time.Time
+
+	// Available holds the number of tokens available when the
+	// take was made, which is negative when tokens are already
+	// reserved by callers still waiting for them.
+	Available int64
+
+	// Reserved holds the number of tokens taken.
+	Reserved int64
+
+	// Ahead holds the number of tokens reserved ahead of the
+	// take - its position in the queue, measured in tokens.
+	Ahead int64
+
+	// Wait holds the time the caller has to wait for the tokens.
+	Wait time.Duration
+
+	// Refused holds ErrVetoed, ErrPenalized or ErrQuotaExhausted
+	// if the take was refused outright by the admission filter, a
+	// penalty or the lifetime quota, in which case no tokens were
+	// taken.
+	Refused error
+}
+
+// TakeTraced is like Take, but also returns a trace of how the wait
+// was worked out. It is meant for diagnosing waits rather than for
+// regular use. Unlike Take, it is subject to WithAdmissionFilter
+// and WithPenalty: a take they refuse takes nothing, and its wait
+// is zero, as it is for a take beyond the lifetime quota.
+func (l *Limiter) TakeTraced(count int64) (time.Duration, TakeTrace) {
+	floored, err := l.refusal(count, "")
+	l.mtx.Lock()
+	defer l.unlock()
+	now := l.now()
+	if err != nil {
+		trace := l.traceAt(now)
+		trace.Refused = err
+		return 0, trace
+	}
+	d, trace := l.takeTraced(now, count)
+	if floored && trace.Reserved > 0 {
+		l.chargeFloor(count)
+	}
+	return d, trace
+}
+
+// takeTraced is the internal version of TakeTraced - it takes the
+// current time as an argument to enable easy testing.
+func (l *Limiter) takeTraced(now time.Time, count int64) (time.Duration, TakeTrace) {
+	trace := l.traceAt(now)
+	var ok bool
+	if trace.Wait, ok = l.take(now, count, infinityDuration); !ok {
+		trace.Refused = ErrQuotaExhausted
+		return trace.Wait, trace
+	}
+	if count > 0 {
+		trace.Reserved = count
+	}
+	return trace.Wait, trace
+}
+
+// traceAt brings the bucket up to date as of now and returns the
+// trace of a take made then, before any tokens are taken.
+// l.mtx must be held.
+func (l *Limiter) traceAt(now time.Time) TakeTrace {
+	l.adjustAvailableTokens(l.currentTick(now))
+	trace := TakeTrace{
+		Time:      now,
+		Available: l.availableTokens,
+	}
+	if l.availableTokens < 0 {
+		trace.Ahead = -l.availableTokens
+	}
+	return trace
+}
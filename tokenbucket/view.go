@@ -0,0 +1,53 @@
+package tokenbucket
+
+import "time"
+
+// LimiterView is a snapshot of the state of a Limiter, as returned
+// by View. Its fields are all taken at the same instant.
+type LimiterView struct {
+	// Time holds the time at which the snapshot was taken.
+	Time time.Time
+	// Available holds the number of available tokens, which is
+	// negative when there are consumers waiting for tokens.
+	Available int64
+	// Capacity holds the capacity of the bucket.
+	Capacity int64
+	// Rate holds the rate, in tokens per second, at which the
+	// bucket fills.
+	Rate float64
+	// FillInterval and Quantum hold the interval at which the
+	// bucket fills and the number of tokens added each time.
+	FillInterval time.Duration
+	Quantum      int64
+	// LastTake holds the time at which the tokens of the most
+	// recent successful take were granted, as returned by
+	// LastTake.
+	LastTake time.Time
+	// Stats holds the limiter's activity counters.
+	Stats Stats
+	// Wasted holds the number of tokens lost to the bucket being
+	// full, as returned by WastedTokens.
+	Wasted int64
+}
+
+// View returns a snapshot of the limiter's state, taken under a
+// single acquisition of its lock so that the values are mutually
+// consistent, unlike those returned by separate calls to Available,
+// Capacity, Rate and the like.
+func (l *Limiter) View() LimiterView {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	now := l.now()
+	l.adjustAvailableTokens(l.currentTick(now))
+	return LimiterView{
+		Time:         now,
+		Available:    l.availableTokens,
+		Capacity:     l.capacity,
+		Rate:         fillRate(l.fillInterval, l.quantum),
+		FillInterval: l.fillInterval,
+		Quantum:      l.quantum,
+		LastTake:     l.lastTake,
+		Stats:        l.stats,
+		Wasted:       l.wasted,
+	}
+}
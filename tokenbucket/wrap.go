@@ -0,0 +1,19 @@
+//go:build go1.21
+
+package tokenbucket
+
+import "context"
+
+// Wrap returns a version of fn that waits for a token from l, as
+// WaitContext does, before each call. If the wait fails, because ctx
+// is done or for any other reason WaitContext gives, fn is not called
+// and the zero value of R is returned with the error.
+func Wrap[T, R any](l *Limiter, fn func(T) (R, error)) func(context.Context, T) (R, error) {
+	return func(ctx context.Context, arg T) (R, error) {
+		if err := l.WaitContext(ctx, 1); err != nil {
+			var zero R
+			return zero, err
+		}
+		return fn(arg)
+	}
+}
@@ -0,0 +1,48 @@
+//go:build go1.21
+
+package tokenbucket
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestWrap(t *testing.T) {
+	c := newFakeClock()
+	l := NewLimiterWithClock(10*time.Millisecond, 1, c)
+	start := c.Now()
+
+	var calls []time.Duration
+	itoa := Wrap(l, func(i int) (string, error) {
+		calls = append(calls, c.Now().Sub(start))
+		if i < 0 {
+			return "", errors.New("negative")
+		}
+		return strconv.Itoa(i), nil
+	})
+	for i := 0; i < 3; i++ {
+		if s, err := itoa(context.Background(), i); s != strconv.Itoa(i) || err != nil {
+			t.Fatalf("call %d returned %q, %v", i, s, err)
+		}
+	}
+	if _, err := itoa(context.Background(), -1); err == nil || err.Error() != "negative" {
+		t.Fatalf("error from wrapped function not returned: %v", err)
+	}
+	want := []time.Duration{0, 10 * time.Millisecond, 20 * time.Millisecond, 30 * time.Millisecond}
+	if !slices.Equal(calls, want) {
+		t.Fatalf("calls made at %v, want %v", calls, want)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if s, err := itoa(ctx, 7); s != "" || err != context.Canceled {
+		t.Fatalf("call with cancelled context returned %q, %v", s, err)
+	}
+	if len(calls) != len(want) {
+		t.Fatalf("wrapped function called %d times, want %d", len(calls), len(want))
+	}
+}
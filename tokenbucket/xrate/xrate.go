@@ -0,0 +1,179 @@
+// Package xrate adapts tokenbucket.Limiter to the API of rate.Limiter
+// from golang.org/x/time/rate, and converts between the two, to ease
+// migrating code written against it.
+package xrate
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/GodYY/ratelimit/tokenbucket"
+	"golang.org/x/time/rate"
+)
+
+// Adapter gives a Limiter the method set of rate.Limiter.
+// Methods on Adapter may be called concurrently.
+//
+// The semantics match where the two designs allow. The differences
+// are:
+//
+//   - Tokens accrue in whole quanta, once every fill interval, rather
+//     than continuously, so counts agree with rate.Limiter only at
+//     the ends of fill intervals, and Tokens is always a whole number.
+//   - The times passed to AllowN and ReserveN are accepted for
+//     compatibility but ignored: the limiter's own clock is used.
+//   - Reservations cannot be cancelled, as tokens cannot be returned
+//     to the bucket.
+//   - The limiter's admission filter, penalty and lifetime quota, if
+//     any, apply as they do to its own methods.
+type Adapter struct {
+	l *tokenbucket.Limiter
+}
+
+// NewAdapter returns an adapter for l.
+func NewAdapter(l *tokenbucket.Limiter) *Adapter {
+	return &Adapter{l: l}
+}
+
+// Limit returns the rate at which the bucket fills, in tokens per
+// second.
+func (a *Adapter) Limit() rate.Limit {
+	return rate.Limit(a.l.Rate())
+}
+
+// Burst returns the capacity of the bucket.
+func (a *Adapter) Burst() int {
+	return int(a.l.Capacity())
+}
+
+// Tokens returns the number of tokens available.
+func (a *Adapter) Tokens() float64 {
+	return float64(a.l.Available())
+}
+
+// TokensAt returns the number of tokens that will be available at
+// time t if none are taken in the meantime.
+func (a *Adapter) TokensAt(t time.Time) float64 {
+	return float64(a.l.AvailableAt(t))
+}
+
+// Allow is shorthand for AllowN(time.Now(), 1).
+func (a *Adapter) Allow() bool {
+	return a.AllowN(time.Now(), 1)
+}
+
+// AllowN reports whether n tokens are available now, taking them if
+// so.
+func (a *Adapter) AllowN(t time.Time, n int) bool {
+	_, ok := a.l.TakeMaxDuration(int64(n), 0)
+	return ok
+}
+
+// Wait is shorthand for WaitN(ctx, 1).
+func (a *Adapter) Wait(ctx context.Context) error {
+	return a.WaitN(ctx, 1)
+}
+
+// WaitN blocks until n tokens are available, as WaitContext does. It
+// returns an error straight away if n exceeds the bucket's capacity.
+func (a *Adapter) WaitN(ctx context.Context, n int) error {
+	if capacity := a.l.Capacity(); int64(n) > capacity {
+		return fmt.Errorf("xrate: Wait(n=%d) exceeds limiter's burst %d", n, capacity)
+	}
+	return a.l.WaitContext(ctx, int64(n))
+}
+
+// Reserve is shorthand for ReserveN(time.Now(), 1).
+func (a *Adapter) Reserve() *Reservation {
+	return a.ReserveN(time.Now(), 1)
+}
+
+// ReserveN takes n tokens, returning a reservation that says how long
+// to wait before they are available. The reservation is not OK, and
+// takes nothing, if n exceeds the bucket's capacity or the take is
+// refused.
+func (a *Adapter) ReserveN(t time.Time, n int) *Reservation {
+	l := a.l
+	if int64(n) > l.Capacity() {
+		return &Reservation{l: l}
+	}
+	now := l.View().Time
+	d, ok := l.TakeMaxDuration(int64(n), rate.InfDuration)
+	return &Reservation{
+		l:         l,
+		ok:        ok,
+		timeToAct: now.Add(d),
+	}
+}
+
+// Reservation holds tokens reserved by Adapter.ReserveN. Unlike
+// rate.Reservation, it cannot be cancelled.
+type Reservation struct {
+	l         *tokenbucket.Limiter
+	ok        bool
+	timeToAct time.Time
+}
+
+// OK reports whether the tokens were reserved.
+func (r *Reservation) OK() bool {
+	return r.ok
+}
+
+// Delay is shorthand for DelayFrom with the limiter's current time.
+func (r *Reservation) Delay() time.Duration {
+	return r.DelayFrom(r.l.View().Time)
+}
+
+// DelayFrom returns how long after t the reserved tokens become
+// available. A reservation that is not OK has an infinite delay.
+func (r *Reservation) DelayFrom(t time.Time) time.Duration {
+	if !r.ok {
+		return rate.InfDuration
+	}
+	if d := r.timeToAct.Sub(t); d > 0 {
+		return d
+	}
+	return 0
+}
+
+// FromRateLimiter returns a Limiter with the rate, burst and
+// available tokens of lim as of now, which uses the given clock, or
+// the system clock if clock is nil. The two limiters are independent
+// thereafter. It panics if lim's limit is not positive and finite.
+func FromRateLimiter(lim *rate.Limiter, clock tokenbucket.Clock, opts ...tokenbucket.Option) *tokenbucket.Limiter {
+	limit := float64(lim.Limit())
+	if limit <= 0 || math.IsInf(limit, 1) {
+		panic("token bucket rate is not > 0 and finite")
+	}
+	burst := int64(lim.Burst())
+	l := tokenbucket.NewLimiterWithRateAndClock(limit, burst, clock, opts...)
+	// Take the used tokens from a bare limiter, so that l's options
+	// do not count or veto the take, and give l its state.
+	bare := tokenbucket.NewLimiterWithRateAndClock(limit, burst, clock)
+	bare.Take(burst - int64(math.Floor(lim.Tokens())))
+	if err := l.LoadStateBytes(bare.StateBytes()); err != nil {
+		panic(err)
+	}
+	return l
+}
+
+// ToRateLimiter returns a rate.Limiter with the rate, capacity and
+// available tokens of l as of now. The two limiters are independent
+// thereafter. As rate.Limiter uses the system clock, the result is
+// only meaningful for limiters that do too.
+func ToRateLimiter(l *tokenbucket.Limiter) *rate.Limiter {
+	now := time.Now()
+	capacity := l.Capacity()
+	lim := rate.NewLimiter(rate.Limit(l.Rate()), int(capacity))
+	// rate.Limiter reserves at most its burst at a time.
+	for used := capacity - l.Available(); used > 0; used -= capacity {
+		n := used
+		if n > capacity {
+			n = capacity
+		}
+		lim.ReserveN(now, int(n))
+	}
+	return lim
+}
@@ -0,0 +1,113 @@
+package xrate
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/GodYY/ratelimit/tokenbucket"
+	"golang.org/x/time/rate"
+)
+
+type fakeClock struct {
+	mtx sync.Mutex
+	now time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Sleep(d time.Duration) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if d > 0 {
+		c.now = c.now.Add(d)
+	}
+}
+
+func TestAdapter(t *testing.T) {
+	c := newFakeClock()
+	a := NewAdapter(tokenbucket.NewLimiterWithRateAndClock(10, 5, c))
+	std := rate.NewLimiter(10, 5)
+	if a.Limit() != std.Limit() || a.Burst() != std.Burst() {
+		t.Fatalf("limit %v and burst %d, want %v and %d", a.Limit(), a.Burst(), std.Limit(), std.Burst())
+	}
+
+	// Steps are whole fill intervals, at the ends of which the two
+	// limiters agree.
+	for i, step := range []struct {
+		sleep   time.Duration
+		allow   int
+		reserve int
+	}{
+		{allow: 3},
+		{allow: 3},
+		{allow: 2},
+		{sleep: 100 * time.Millisecond, allow: 1},
+		{allow: 1},
+		{sleep: 300 * time.Millisecond, allow: 4},
+		{allow: 2},
+		{reserve: 2},
+		{sleep: 100 * time.Millisecond, reserve: 3},
+		{sleep: 400 * time.Millisecond, allow: 1},
+		{sleep: time.Second, allow: 6},
+		{reserve: 6},
+		{allow: 5},
+	} {
+		c.Sleep(step.sleep)
+		now := c.Now()
+		if got, want := a.TokensAt(now), std.TokensAt(now); got != want {
+			t.Fatalf("step %d: tokens %g, want %g", i, got, want)
+		}
+		if step.allow > 0 {
+			if got, want := a.AllowN(now, step.allow), std.AllowN(now, step.allow); got != want {
+				t.Fatalf("step %d: AllowN(%d) = %v, want %v", i, step.allow, got, want)
+			}
+		}
+		if step.reserve > 0 {
+			r, stdr := a.ReserveN(now, step.reserve), std.ReserveN(now, step.reserve)
+			if r.OK() != stdr.OK() || r.DelayFrom(now) != stdr.DelayFrom(now) {
+				t.Fatalf("step %d: ReserveN(%d) = %v, %v, want %v, %v", i, step.reserve, r.OK(), r.DelayFrom(now), stdr.OK(), stdr.DelayFrom(now))
+			}
+		}
+	}
+
+	if err := a.WaitN(context.Background(), 6); err == nil {
+		t.Fatalf("WaitN beyond the burst succeeded")
+	}
+}
+
+func TestRateLimiterBridge(t *testing.T) {
+	std := rate.NewLimiter(1, 10)
+	std.AllowN(time.Now(), 4)
+	l := FromRateLimiter(std, nil, tokenbucket.WithAdmissionFilter(func(int64) bool {
+		return false
+	}))
+	if !tokenbucket.ApproxEqualRate(l.Rate(), 1) || l.Capacity() != 10 {
+		t.Fatalf("rate %g and capacity %d, want 1 and 10", l.Rate(), l.Capacity())
+	}
+	if avail := l.Available(); avail != 6 {
+		t.Fatalf("available %d, want 6", avail)
+	}
+	if s := l.Stats(); s != (tokenbucket.Stats{}) {
+		t.Fatalf("stats %+v, want none", s)
+	}
+
+	l = tokenbucket.NewLimiterWithRate(1e-3, 20)
+	l.Take(25)
+	std = ToRateLimiter(l)
+	if std.Limit() != rate.Limit(l.Rate()) || std.Burst() != 20 {
+		t.Fatalf("limit %v and burst %d, want %v and 20", std.Limit(), std.Burst(), l.Rate())
+	}
+	if tokens := std.Tokens(); tokens > -4.9 || tokens < -5 {
+		t.Fatalf("tokens %g, want -5", tokens)
+	}
+}